@@ -0,0 +1,61 @@
+package retryable
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// credentialHeaders are stripped from polls of a Location on another host, as
+// net/http does when following redirects
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Www-Authenticate", "Cookie", "Cookie2"}
+
+// pollAsync follows the Location of a `202 Accepted` response, polling it until
+// it gives something other than a 202. resp is returned as is should it not be a
+// 202, or have no Location to follow
+func (h HttpClient) pollAsync(ctx context.Context, req *http.Request, resp *http.Response) (*http.Response, error) {
+	if resp.StatusCode != http.StatusAccepted {
+		return resp, nil
+	}
+
+	// Location resolves relative URLs against the request
+	loc, err := resp.Location()
+	if err != nil {
+		return resp, nil
+	}
+
+	pollReq, err := http.NewRequestWithContext(ctx, http.MethodGet, loc.String(), nil)
+	if err != nil {
+		return resp, err
+	}
+
+	// Carry over things like auth, but not anything describing the original body,
+	// nor the idempotency key, else Store would mistake polls for replays
+	pollReq.Header = req.Header.Clone()
+	for _, k := range []string{"Content-Type", "Content-Length", "Content-Digest", IdempotencyKeyHeader} {
+		pollReq.Header.Del(k)
+	}
+
+	// As with redirects, credentials are only for the host they were meant for
+	if !strings.EqualFold(loc.Host, req.URL.Host) {
+		for _, k := range credentialHeaders {
+			pollReq.Header.Del(k)
+		}
+	}
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	// h already judges success as the call would, ctx's override and all. The
+	// wrapped predicate goes on ctx too, else that override would displace it
+	pred := func(resp *http.Response) bool {
+		return resp.StatusCode != http.StatusAccepted && h.isSuccess(resp)
+	}
+
+	c := h
+	c.AsyncPoll = false
+	c.SuccessPredicate = pred
+
+	return c.DoWithContext(ContextWithSuccessPredicate(ctx, pred), pollReq)
+}
@@ -0,0 +1,290 @@
+package retryable
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	backoff "github.com/cenkalti/backoff/v5"
+)
+
+// JitterStrategy selects how the intervals between attempts are randomised, which
+// stops clients which failed together from retrying together
+type JitterStrategy int
+
+const (
+	// FullJitter randomises each exponentially growing interval by up to 50% in
+	// either direction. This is the default
+	FullJitter JitterStrategy = iota
+
+	// DecorrelatedJitter picks each interval at random from between the initial
+	// interval and three times the previous interval, capped at MaxInterval, as
+	// per the AWS Architecture Blog's "Exponential Backoff And Jitter"
+	DecorrelatedJitter
+
+	// NoJitter uses the exponentially growing intervals as they are
+	NoJitter
+)
+
+// String implements the fmt.Stringer interface
+func (s JitterStrategy) String() string {
+	switch s {
+	case FullJitter:
+		return "full jitter"
+	case DecorrelatedJitter:
+		return "decorrelated jitter"
+	case NoJitter:
+		return "no jitter"
+	}
+
+	return fmt.Sprintf("JitterStrategy(%d)", int(s))
+}
+
+// BackoffConfig returns the exponential backoff settings calls through this client
+// use, with defaults filled in, which is handy for checking tuning.
+//
+// DecorrelatedJitter only takes InitialInterval and MaxInterval from these
+func (h HttpClient) BackoffConfig() backoff.ExponentialBackOff {
+	bo := backoff.NewExponentialBackOff()
+	bo.MaxInterval = h.MaxInterval
+
+	if h.InitialInterval > 0 {
+		bo.InitialInterval = h.InitialInterval
+	}
+
+	if h.Multiplier > 0 {
+		bo.Multiplier = h.Multiplier
+	}
+
+	if h.JitterStrategy == NoJitter {
+		bo.RandomizationFactor = 0
+	}
+
+	return *bo
+}
+
+// backOffProvider supplies the schedule of a call to DoWithContext, and the means
+// of waiting it out. It's a seam for tests, which would rather not sleep
+type backOffProvider interface {
+	// newBackOff returns the schedule for a single call made by h
+	newBackOff(h HttpClient) backoff.BackOff
+
+	// wait blocks for d, or until ctx is done, in which case it returns the cause
+	wait(ctx context.Context, d time.Duration) error
+}
+
+// backOffs returns the backOffProvider calls through this client should use
+func (h HttpClient) backOffs() backOffProvider {
+	if h.backOffProvider != nil {
+		return h.backOffProvider
+	}
+
+	return sleepingBackOffs{clock: h.clock()}
+}
+
+// sleepingBackOffs follows the client's schedule, sleeping on its clock
+type sleepingBackOffs struct {
+	clock Clock
+}
+
+func (sleepingBackOffs) newBackOff(h HttpClient) backoff.BackOff {
+	return h.newBackOff()
+}
+
+func (s sleepingBackOffs) wait(ctx context.Context, d time.Duration) error {
+	return s.clock.Sleep(ctx, d)
+}
+
+// instantBackOffs follows the client's schedule, but without any of the waiting
+type instantBackOffs struct{}
+
+func (instantBackOffs) newBackOff(h HttpClient) backoff.BackOff {
+	return h.newBackOff()
+}
+
+func (instantBackOffs) wait(ctx context.Context, _ time.Duration) error {
+	return context.Cause(ctx)
+}
+
+// newBackOff returns the schedule for a single call to DoWithContext; backoffs
+// aren't thread safe, so every call needs its own
+func (h HttpClient) newBackOff() backoff.BackOff {
+	bo := h.jitteredSchedule()
+
+	if h.ImmediateRetries > 0 {
+		bo = &immediateBackOff{BackOff: bo, n: h.ImmediateRetries}
+	}
+
+	if h.FastFirstRetry {
+		return &fastFirstBackOff{BackOff: bo, delay: h.FastFirstRetryDelay}
+	}
+
+	return bo
+}
+
+// jitteredSchedule returns the exponential schedule, randomised as per
+// JitterStrategy
+func (h HttpClient) jitteredSchedule() backoff.BackOff {
+	cfg := h.BackoffConfig()
+	bo := &cfg
+
+	switch h.JitterStrategy {
+	case DecorrelatedJitter:
+		return &decorrelatedBackOff{
+			base:   bo.InitialInterval,
+			cap:    bo.MaxInterval,
+			random: h.randFloat64,
+		}
+
+	case NoJitter:
+		return bo
+	}
+
+	if h.Rand == nil {
+		return bo
+	}
+
+	// The backoff package always draws from the global random source, so take
+	// over the randomisation ourselves
+	jb := &jitteredBackOff{
+		BackOff: bo,
+		factor:  bo.RandomizationFactor,
+		rand:    h.Rand,
+	}
+
+	bo.RandomizationFactor = 0
+
+	return jb
+}
+
+// retryAfter returns an error which tells retry to wait for d before the next
+// attempt, after d has been through retryAfterDelay
+func (h HttpClient) retryAfter(d time.Duration) error {
+	return &backoff.RetryAfterError{Duration: h.retryAfterDelay(d)}
+}
+
+// retryAfterDelay spreads a delay asked for by a server according to
+// RetryAfterJitter, then bounds it by MinRetryAfter and MaxRetryAfter
+func (h HttpClient) retryAfterDelay(d time.Duration) time.Duration {
+	if h.RetryAfterJitter > 0 {
+		d += time.Duration(h.randFloat64() * h.RetryAfterJitter * float64(d))
+	}
+
+	if h.MaxRetryAfter > 0 {
+		d = min(d, h.MaxRetryAfter)
+	}
+
+	return max(d, h.MinRetryAfter)
+}
+
+// randFloat64 returns a random number in [0.0,1.0) from Rand, where set, or from
+// the global source otherwise
+func (h HttpClient) randFloat64() float64 {
+	if h.Rand != nil {
+		return h.Rand.Float64()
+	}
+
+	return rand.Float64() // #nosec G404 -- jitter needn't be cryptographically secure
+}
+
+// jitteredBackOff randomises the intervals of an unrandomised backoff, in exactly
+// the same way backoff.ExponentialBackOff would, but using a source of our choosing
+type jitteredBackOff struct {
+	backoff.BackOff
+
+	factor float64
+	rand   *rand.Rand
+}
+
+// NextBackOff implements the backoff.BackOff interface
+func (b *jitteredBackOff) NextBackOff() time.Duration {
+	next := b.BackOff.NextBackOff()
+	if next == backoff.Stop || b.factor == 0 {
+		return next
+	}
+
+	delta := b.factor * float64(next)
+	lower := float64(next) - delta
+	upper := float64(next) + delta
+
+	// As per the backoff package, the +1 gives an even chance of picking either end
+	// of the range
+	return time.Duration(lower + (b.rand.Float64() * (upper - lower + 1)))
+}
+
+// decorrelatedBackOff implements decorrelated jitter, where each interval is
+// drawn from [base, prev*3], and capped
+type decorrelatedBackOff struct {
+	base, cap, prev time.Duration
+	random          func() float64
+}
+
+// Reset implements the backoff.BackOff interface
+func (b *decorrelatedBackOff) Reset() {
+	b.prev = b.base
+}
+
+// NextBackOff implements the backoff.BackOff interface
+func (b *decorrelatedBackOff) NextBackOff() time.Duration {
+	next := b.base + time.Duration(b.random()*float64(3*b.prev-b.base))
+	if b.cap > 0 {
+		next = min(next, b.cap)
+	}
+
+	b.prev = next
+
+	return next
+}
+
+// fastFirstBackOff waits a fixed delay before the first retry, and follows the
+// wrapped schedule from then on
+type fastFirstBackOff struct {
+	backoff.BackOff
+
+	delay time.Duration
+	used  bool
+}
+
+// NextBackOff implements the backoff.BackOff interface
+func (b *fastFirstBackOff) NextBackOff() time.Duration {
+	if !b.used {
+		b.used = true
+
+		return b.delay
+	}
+
+	return b.BackOff.NextBackOff()
+}
+
+// Reset implements the backoff.BackOff interface
+func (b *fastFirstBackOff) Reset() {
+	b.used = false
+	b.BackOff.Reset()
+}
+
+// immediateBackOff doesn't wait at all before the first n retries, and follows the
+// wrapped schedule from then on
+type immediateBackOff struct {
+	backoff.BackOff
+
+	n    int
+	used int
+}
+
+// NextBackOff implements the backoff.BackOff interface
+func (b *immediateBackOff) NextBackOff() time.Duration {
+	if b.used < b.n {
+		b.used++
+
+		return 0
+	}
+
+	return b.BackOff.NextBackOff()
+}
+
+// Reset implements the backoff.BackOff interface
+func (b *immediateBackOff) Reset() {
+	b.used = 0
+	b.BackOff.Reset()
+}
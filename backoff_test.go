@@ -0,0 +1,254 @@
+package retryable
+
+import (
+	"errors"
+	"math/rand/v2"
+	"testing"
+	"time"
+
+	backoff "github.com/cenkalti/backoff/v5"
+)
+
+func TestHttpClient_newBackOff_Rand(t *testing.T) {
+	schedule := func(seed uint64) (s []time.Duration) {
+		c := New()
+		c.Rand = rand.New(rand.NewPCG(seed, seed))
+
+		bo := c.newBackOff()
+		for i := 0; i < 10; i++ {
+			s = append(s, bo.NextBackOff())
+		}
+
+		return
+	}
+
+	a, b, other := schedule(1), schedule(1), schedule(2)
+
+	for i := range a {
+		if a[i] != b[i] {
+			t.Errorf("interval %d: expected %s, received %s", i, a[i], b[i])
+		}
+
+		// The first interval is 500ms, give or take 50%
+		if i == 0 && (a[i] < 250*time.Millisecond || a[i] > 750*time.Millisecond) {
+			t.Errorf("interval %d: %s is outside of the expected range", i, a[i])
+		}
+	}
+
+	if a[0] == other[0] {
+		t.Error("expected differently seeded clients to have different schedules")
+	}
+}
+
+func TestHttpClient_retryAfter(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		jitter   float64
+		min, max time.Duration
+		from, to time.Duration
+	}{
+		{"No jitter honours the delay exactly", 0, 0, 0, 10 * time.Second, 10 * time.Second},
+		{"Jitter only ever adds to the delay", 0.5, 0, 0, 10 * time.Second, 15 * time.Second},
+		{"Jitter may double the delay", 1, 0, 0, 10 * time.Second, 20 * time.Second},
+		{"MaxRetryAfter caps the delay", 0, 0, time.Second, time.Second, time.Second},
+		{"MaxRetryAfter caps jitter too", 1, 0, 12 * time.Second, 10 * time.Second, 12 * time.Second},
+		{"MinRetryAfter floors the delay", 0, time.Minute, 0, time.Minute, time.Minute},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := New()
+			c.RetryAfterJitter = test.jitter
+			c.MinRetryAfter = test.min
+			c.MaxRetryAfter = test.max
+
+			seen := make(map[time.Duration]bool)
+
+			for i := 0; i < 100; i++ {
+				var rae *backoff.RetryAfterError
+				if !errors.As(c.retryAfter(10*time.Second), &rae) {
+					t.Fatal("expected a RetryAfterError")
+				}
+
+				if rae.Duration < test.from || rae.Duration > test.to {
+					t.Fatalf("%s is outside of [%s, %s]", rae.Duration, test.from, test.to)
+				}
+
+				seen[rae.Duration] = true
+			}
+
+			if test.jitter > 0 && test.max == 0 && len(seen) == 1 {
+				t.Error("expected delays to be spread out")
+			}
+		})
+	}
+}
+
+func TestHttpClient_newBackOff_JitterStrategy(t *testing.T) {
+	t.Run("No jitter", func(t *testing.T) {
+		c := New()
+		c.JitterStrategy = NoJitter
+
+		bo := c.newBackOff()
+		bo.Reset()
+
+		for _, expect := range []time.Duration{500 * time.Millisecond, 750 * time.Millisecond, 1125 * time.Millisecond} {
+			if next := bo.NextBackOff(); expect != next {
+				t.Errorf("expected %s, received %s", expect, next)
+			}
+		}
+	})
+
+	t.Run("Decorrelated jitter", func(t *testing.T) {
+		c := New()
+		c.JitterStrategy = DecorrelatedJitter
+		c.MaxInterval = 10 * time.Second
+		c.Rand = rand.New(rand.NewPCG(1, 1))
+
+		bo := c.newBackOff()
+		bo.Reset()
+
+		prev := 500 * time.Millisecond
+
+		for i := 0; i < 20; i++ {
+			next := bo.NextBackOff()
+			if next < 500*time.Millisecond || next > min(3*prev, c.MaxInterval) {
+				t.Fatalf("interval %d: %s is outside of [500ms, %s]", i, next, min(3*prev, c.MaxInterval))
+			}
+
+			prev = next
+		}
+	})
+}
+
+func TestHttpClient_newBackOff_Schedule(t *testing.T) {
+	c := New()
+	c.JitterStrategy = NoJitter
+	c.InitialInterval = 100 * time.Millisecond
+	c.Multiplier = 2
+	c.MaxInterval = time.Second
+
+	bo := c.newBackOff()
+
+	for i, expect := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		next := bo.NextBackOff()
+		if expect*time.Millisecond != next {
+			t.Errorf("interval %d: expected %s, received %s", i, expect*time.Millisecond, next)
+		}
+	}
+}
+
+func TestHttpClient_BackoffConfig(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		c      HttpClient
+		expect backoff.ExponentialBackOff
+	}{
+		{"Defaults", HttpClient{MaxInterval: time.Minute}, backoff.ExponentialBackOff{
+			InitialInterval:     500 * time.Millisecond,
+			RandomizationFactor: 0.5,
+			Multiplier:          1.5,
+			MaxInterval:         time.Minute,
+		}},
+		{"Tuned, without jitter", HttpClient{MaxInterval: time.Second, InitialInterval: time.Millisecond, Multiplier: 3, JitterStrategy: NoJitter}, backoff.ExponentialBackOff{
+			InitialInterval:     time.Millisecond,
+			RandomizationFactor: 0,
+			Multiplier:          3,
+			MaxInterval:         time.Second,
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if cfg := test.c.BackoffConfig(); test.expect != cfg {
+				t.Errorf("expected %#v, received %#v", test.expect, cfg)
+			}
+		})
+	}
+}
+
+func TestJitterStrategy_String(t *testing.T) {
+	for _, test := range []struct {
+		s      JitterStrategy
+		expect string
+	}{
+		{FullJitter, "full jitter"},
+		{DecorrelatedJitter, "decorrelated jitter"},
+		{NoJitter, "no jitter"},
+		{JitterStrategy(99), "JitterStrategy(99)"},
+	} {
+		if test.expect != test.s.String() {
+			t.Errorf("expected %q, received %q", test.expect, test.s.String())
+		}
+	}
+}
+
+func TestHttpClient_newBackOff_FastFirstRetry(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		delay  time.Duration
+		expect []time.Duration
+	}{
+		{"Immediate first retry", 0, []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond}},
+		{"Configured first retry", 5 * time.Millisecond, []time.Duration{5 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := New()
+			c.JitterStrategy = NoJitter
+			c.InitialInterval = 100 * time.Millisecond
+			c.Multiplier = 2
+			c.FastFirstRetry = true
+			c.FastFirstRetryDelay = test.delay
+
+			bo := c.newBackOff()
+			bo.Reset()
+
+			for i, expect := range test.expect {
+				next := bo.NextBackOff()
+				if expect != next {
+					t.Errorf("interval %d: expected %s, received %s", i, expect, next)
+				}
+			}
+
+			// As happens on a 429, which starts the schedule over
+			bo.Reset()
+
+			for i, expect := range test.expect {
+				next := bo.NextBackOff()
+				if expect != next {
+					t.Errorf("interval %d after reset: expected %s, received %s", i, expect, next)
+				}
+			}
+		})
+	}
+}
+
+func TestHttpClient_newBackOff_ImmediateRetries(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		immediate int
+		fastFirst bool
+		expect    []time.Duration
+	}{
+		{"No immediate retries", 0, false, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond}},
+		{"One immediate retry", 1, false, []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond}},
+		{"Several immediate retries", 3, false, []time.Duration{0, 0, 0, 100 * time.Millisecond, 200 * time.Millisecond}},
+		{"Immediate retries follow a fast first one", 2, true, []time.Duration{5 * time.Millisecond, 0, 0, 100 * time.Millisecond}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := New()
+			c.JitterStrategy = NoJitter
+			c.InitialInterval = 100 * time.Millisecond
+			c.Multiplier = 2
+			c.ImmediateRetries = test.immediate
+			c.FastFirstRetry = test.fastFirst
+			c.FastFirstRetryDelay = 5 * time.Millisecond
+
+			bo := c.newBackOff()
+			bo.Reset()
+
+			for i, expect := range test.expect {
+				next := bo.NextBackOff()
+				if expect != next {
+					t.Errorf("interval %d: expected %s, received %s", i, expect, next)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package retryable
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// maxDrainBytes bounds how much of a discarded response body is read in the hope of
+// reusing its connection; past this, it's cheaper to open a new one
+const maxDrainBytes = 64 << 10
+
+// discard drains and closes the body of a response which won't be returned to the
+// caller. The transport only reuses connections whose responses were read to the
+// end, so without this every retry would need a new connection
+func discard(resp *http.Response) {
+	if resp == nil || resp.Body == nil {
+		return
+	}
+
+	_, _ = io.CopyN(io.Discard, resp.Body, maxDrainBytes)
+	_ = resp.Body.Close()
+}
+
+// bufferBody reads resp's body into memory, replacing it with an in-memory copy
+// so that the caller can still read it afterwards
+func bufferBody(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+
+	return b, nil
+}
+
+// peekBody reads up to n bytes of resp's body, putting them back in front of the
+// rest of the body so that the caller can still read the whole thing
+func peekBody(resp *http.Response, n int64) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(resp.Body, n))
+
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), resp.Body), resp.Body}
+
+	return b, err
+}
+
+// checkBodyContains returns a transient error should resp's body contain any of
+// RetryOnBodyContains
+func (h HttpClient) checkBodyContains(resp *http.Response) error {
+	b, err := bufferBody(resp)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range h.RetryOnBodyContains {
+		if bytes.Contains(b, []byte(s)) {
+			return fmt.Errorf("%s: response body contains %q", resp.Status, s)
+		}
+	}
+
+	return nil
+}
+
+// checkEmptyBody returns a transient error should resp have an empty body where
+// one was expected, as per RetryOnEmptyBody
+func checkEmptyBody(resp *http.Response) error {
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified ||
+		(resp.Request != nil && resp.Request.Method == http.MethodHead) {
+		return nil
+	}
+
+	if resp.ContentLength > 0 {
+		return nil
+	}
+
+	b, err := peekBody(resp, 1)
+	if err != nil {
+		return err
+	}
+
+	if len(b) == 0 {
+		return fmt.Errorf("%s: response body is empty", resp.Status)
+	}
+
+	return nil
+}
+
+// checkJSONErrorCode returns a transient error should resp's body be JSON with one
+// of RetryableJSONCodes at JSONErrorCodePath
+func (h HttpClient) checkJSONErrorCode(resp *http.Response) error {
+	b, err := bufferBody(resp)
+	if err != nil {
+		return err
+	}
+
+	code, ok := jsonCodeAt(b, h.JSONErrorCodePath)
+	if !ok || !slices.Contains(h.RetryableJSONCodes, code) {
+		return nil
+	}
+
+	return fmt.Errorf("%s: response body has error code %q", resp.Status, code)
+}
+
+// jsonCodeAt returns the string or number found at the dotted path within the JSON
+// in b, returning false where b isn't JSON or there's no such value
+func jsonCodeAt(b []byte, path string) (string, bool) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	var v any
+
+	err := d.Decode(&v)
+	if err != nil {
+		return "", false
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return "", false
+		}
+
+		v, ok = obj[key]
+		if !ok {
+			return "", false
+		}
+	}
+
+	switch code := v.(type) {
+	case string:
+		return code, true
+	case json.Number:
+		return code.String(), true
+	}
+
+	return "", false
+}
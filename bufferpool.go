@@ -0,0 +1,137 @@
+package retryable
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// BufferPool recycles the buffers NewRequest (and friends) hold request bodies in,
+// which saves a lot of garbage for high-throughput uploaders. Hand it to requests
+// with WithBufferPool. It is safe for concurrent use, and may be shared by any
+// number of requests
+type BufferPool struct {
+	pool    sync.Pool
+	maxSize int
+}
+
+// NewBufferPool returns an empty BufferPool which keeps hold of buffers of up to
+// maxSize bytes. Bigger buffers are left to the garbage collector, so that the
+// odd huge body doesn't pin its memory for good. 0 means there's no cap
+func NewBufferPool(maxSize int) *BufferPool {
+	return &BufferPool{maxSize: maxSize}
+}
+
+// get returns an empty buffer, from the pool where there is one
+func (p *BufferPool) get() *bytes.Buffer {
+	if b, ok := p.pool.Get().(*bytes.Buffer); ok {
+		return b
+	}
+
+	return new(bytes.Buffer)
+}
+
+// put returns b to the pool, unless it's too big to keep
+func (p *BufferPool) put(b *bytes.Buffer) {
+	if p.maxSize > 0 && b.Cap() > p.maxSize {
+		return
+	}
+
+	b.Reset()
+	p.pool.Put(b)
+}
+
+// pooledBufferContextKey is used to key a request's pooledBuffer within its context
+type pooledBufferContextKey struct{}
+
+// pooledBuffer is a request body drawn from a BufferPool. It goes back to the pool
+// once released, and every reader of it has been closed
+type pooledBuffer struct {
+	pool *BufferPool
+	buf  *bytes.Buffer
+
+	mu       sync.Mutex
+	readers  int
+	released bool
+}
+
+// reader returns a fresh reader of the body, for an attempt
+func (b *pooledBuffer) reader() (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.released {
+		return nil, ErrBodyReleased
+	}
+
+	b.readers++
+
+	return &pooledReader{Reader: bytes.NewReader(b.buf.Bytes()), b: b}, nil
+}
+
+// release marks the body as no longer needed
+func (b *pooledBuffer) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.released = true
+	b.recycle()
+}
+
+// closeReader counts a reader returned by reader as done with
+func (b *pooledBuffer) closeReader() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.readers--
+	b.recycle()
+}
+
+// recycle returns the buffer to the pool, once nothing can read it any more. It
+// must be called with mu held
+func (b *pooledBuffer) recycle() {
+	if !b.released || b.readers > 0 || b.buf == nil {
+		return
+	}
+
+	b.pool.put(b.buf)
+	b.buf = nil
+}
+
+// pooledReader reads a pooledBuffer, and says so once it's closed
+type pooledReader struct {
+	*bytes.Reader
+
+	b    *pooledBuffer
+	once sync.Once
+}
+
+// Close implements io.Closer
+func (r *pooledReader) Close() error {
+	r.once.Do(r.b.closeReader)
+
+	return nil
+}
+
+// releaseBody hands req's body back to its BufferPool, should it have come from one
+func releaseBody(req *http.Request) {
+	if b, ok := req.Context().Value(pooledBufferContextKey{}).(*pooledBuffer); ok {
+		b.release()
+	}
+}
+
+// withPooledBody replaces req's body with readers of b, and keeps hold of b so that
+// DoWithContext can release it
+func withPooledBody(req *http.Request, b *pooledBuffer) (*http.Request, error) {
+	body, err := b.reader()
+	if err != nil {
+		return nil, err
+	}
+
+	req.Body = body
+	req.GetBody = b.reader
+
+	return req.WithContext(context.WithValue(req.Context(), pooledBufferContextKey{}, b)), nil
+}
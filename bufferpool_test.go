@@ -0,0 +1,53 @@
+package retryable
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestPooledBuffer(t *testing.T) {
+	pool := NewBufferPool(0)
+	b := &pooledBuffer{pool: pool, buf: bytes.NewBufferString("hello")}
+
+	r, err := b.reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.release()
+
+	if b.buf == nil {
+		t.Fatal("buffer recycled while still being read")
+	}
+
+	_, err = b.reader()
+	if !errors.Is(err, ErrBodyReleased) {
+		t.Errorf("expected %v, received %v", ErrBodyReleased, err)
+	}
+
+	// Closing twice mustn't count twice
+	r.Close()
+	r.Close()
+
+	if b.buf != nil {
+		t.Error("expected buffer to be recycled")
+	}
+
+	if b.readers != 0 {
+		t.Errorf("expected 0 readers, received %d", b.readers)
+	}
+}
+
+func TestBufferPool_put(t *testing.T) {
+	pool := NewBufferPool(8)
+
+	big := bytes.NewBuffer(make([]byte, 0, 64))
+	pool.put(big)
+
+	// Pools may drop anything they like, but never hand back what they were
+	// never given
+	if b := pool.get(); b == big {
+		t.Error("expected oversized buffer to be dropped")
+	}
+}
@@ -0,0 +1,144 @@
+package retryable
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// StaleHeader is set, to "true", on cached responses returned by StaleOnError in
+// place of an error
+const StaleHeader = "Retryable-Stale"
+
+// CachedResponse is a successful response, kept by a ResponseCache
+type CachedResponse struct {
+	Status     string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+
+	// StoredAt is when the response was received
+	StoredAt time.Time
+}
+
+// A ResponseCache keeps the most recent successful response for each cache key (see
+// HttpClient.CacheKey), so that HttpClient.StaleOnError has something to fall back on
+type ResponseCache interface {
+	// Get returns the response stored for key, if any
+	Get(key string) (CachedResponse, bool)
+
+	// Put stores resp for key, replacing anything stored before
+	Put(key string, resp CachedResponse)
+}
+
+// MemoryResponseCache is a ResponseCache which keeps responses in memory, for the
+// lifetime of the process. It is safe for concurrent use
+type MemoryResponseCache struct {
+	mu        sync.Mutex
+	responses map[string]CachedResponse
+}
+
+// NewMemoryResponseCache returns an empty MemoryResponseCache
+func NewMemoryResponseCache() *MemoryResponseCache {
+	return &MemoryResponseCache{responses: make(map[string]CachedResponse)}
+}
+
+// Get implements the ResponseCache interface
+func (c *MemoryResponseCache) Get(key string) (CachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	resp, ok := c.responses[key]
+
+	return resp, ok
+}
+
+// Put implements the ResponseCache interface
+func (c *MemoryResponseCache) Put(key string, resp CachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.responses[key] = resp
+}
+
+// cacheable returns true for requests whose responses Cache keeps
+func cacheable(req *http.Request) bool {
+	return req.Method == "" || req.Method == http.MethodGet
+}
+
+// cacheKey returns the key under which req's response is cached, as per CacheKey.
+// By default, that's its URL; unless it carries credentials, in which case it
+// isn't cached at all, lest one caller be served another's response
+func (h HttpClient) cacheKey(req *http.Request) (string, bool) {
+	if h.CacheKey != nil {
+		key := h.CacheKey(req)
+
+		return key, key != ""
+	}
+
+	for _, k := range credentialHeaders {
+		if req.Header.Get(k) != "" {
+			return "", false
+		}
+	}
+
+	return req.URL.String(), true
+}
+
+// cacheResponse reads resp's body into memory, replacing it with an in-memory copy,
+// and stores it against req's cache key
+func (h HttpClient) cacheResponse(req *http.Request, resp *http.Response) error {
+	key, ok := h.cacheKey(req)
+	if !ok {
+		return nil
+	}
+
+	b, err := bufferBody(resp)
+	if err != nil {
+		return err
+	}
+
+	h.Cache.Put(key, CachedResponse{
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header.Clone(),
+		Body:       b,
+		StoredAt:   h.clock().Now(),
+	})
+
+	return nil
+}
+
+// staleResponse returns the response cached for req's cache key, marked as stale
+func (h HttpClient) staleResponse(req *http.Request) (*http.Response, bool) {
+	key, ok := h.cacheKey(req)
+	if !ok {
+		return nil, false
+	}
+
+	cached, ok := h.Cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+
+	header := cached.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+
+	header.Set(StaleHeader, "true")
+
+	return &http.Response{
+		Status:        cached.Status,
+		StatusCode:    cached.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(cached.Body)),
+		ContentLength: int64(len(cached.Body)),
+		Request:       req,
+	}, true
+}
@@ -0,0 +1,174 @@
+// Package cassette provides a VCR-style http.RoundTripper, which records real
+// responses to a file the first time it's used, and replays them from that file
+// every time after. This allows code which depends on retry behaviour to be tested
+// without a live server.
+//
+// Plug it in with retryable.NewWithTransport:
+//
+//	cas, err := cassette.New("testdata/fetch-config.json")
+//	if err != nil {
+//		panic(err)
+//	}
+//
+//	c := retryable.NewWithTransport(cas)
+//
+// Delete the file to record afresh.
+package cassette
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Interaction is a single recorded request and its response
+type Interaction struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	StatusCode int         `json:"status"`
+	Header     http.Header `json:"headers"`
+	Body       []byte      `json:"body"`
+}
+
+// Cassette is an http.RoundTripper which either records or replays Interactions,
+// depending on whether its file existed when it was created.
+//
+// When replaying, each request is answered by the first Interaction with a matching
+// method and URL which hasn't already been played. This means a recording of a
+// request failing twice before succeeding plays back in exactly that order.
+type Cassette struct {
+	// Base is used to make real requests while recording. If nil,
+	// http.DefaultTransport is used
+	Base http.RoundTripper
+
+	path      string
+	recording bool
+
+	mu           sync.Mutex
+	interactions []Interaction
+	played       []bool
+}
+
+// New returns a Cassette which replays the Interactions stored at path, or records
+// to path should it not exist
+func New(path string) (*Cassette, error) {
+	c := &Cassette{path: path}
+
+	b, err := os.ReadFile(path) // #nosec G304 -- the path is supplied by the developer
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		c.recording = true
+
+		return c, nil
+
+	case err != nil:
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, &c.interactions)
+	if err != nil {
+		return nil, fmt.Errorf("cassette %s: %w", path, err)
+	}
+
+	c.played = make([]bool, len(c.interactions))
+
+	return c, nil
+}
+
+// Recording returns true if this Cassette is recording, rather than replaying
+func (c *Cassette) Recording() bool {
+	return c.recording
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (c *Cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	if c.recording {
+		return c.record(req)
+	}
+
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, in := range c.interactions {
+		if c.played[i] || in.Method != req.Method || in.URL != req.URL.String() {
+			continue
+		}
+
+		c.played[i] = true
+
+		return in.response(req), nil
+	}
+
+	return nil, fmt.Errorf("cassette %s: no interaction left for %s %s", c.path, req.Method, req.URL)
+}
+
+// record makes req for real, storing the outcome
+func (c *Cassette) record(req *http.Request) (*http.Response, error) {
+	base := c.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	in := Interaction{
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       body,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.interactions = append(c.interactions, in)
+
+	// Save as we go, so there's no need to remember to save at the end
+	b, err := json.MarshalIndent(c.interactions, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(c.path, b, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	return in.response(req), nil
+}
+
+// response builds an *http.Response from a recorded Interaction
+func (in Interaction) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", in.StatusCode, http.StatusText(in.StatusCode)),
+		StatusCode:    in.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        in.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(in.Body)),
+		ContentLength: int64(len(in.Body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,103 @@
+package cassette_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/botsandus/retryable"
+	"github.com/botsandus/retryable/cassette"
+)
+
+func TestCassette(t *testing.T) {
+	var calls int
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+
+		w.Header().Set("X-Hello", "world")
+		_, _ = io.WriteString(w, "some config")
+	}))
+
+	path := filepath.Join(t.TempDir(), "cassette.json")
+
+	get := func(t *testing.T) {
+		t.Helper()
+
+		cas, err := cassette.New(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := retryable.NewWithTransport(cas)
+		c.MaxInterval = time.Millisecond
+
+		ctx := retryable.NewContext()
+
+		resp, err := c.DoWithContext(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer resp.Body.Close()
+
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != "some config" || resp.Header.Get("X-Hello") != "world" {
+			t.Errorf("unexpected response %q, %v", b, resp.Header)
+		}
+
+		attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+		if attempts != 2 {
+			t.Errorf("expected 2 attempts, received %d", attempts)
+		}
+	}
+
+	t.Run("record", get)
+
+	ts.Close()
+
+	t.Run("replay", get)
+
+	if calls != 2 {
+		t.Errorf("expected the server to be called twice, not %d times", calls)
+	}
+
+	t.Run("replay exhausted", func(t *testing.T) {
+		cas, err := cassette.New(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cas.Recording() {
+			t.Fatal("expected to be replaying")
+		}
+
+		req, err := http.NewRequest(http.MethodPost, ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = cas.RoundTrip(req)
+		if err == nil {
+			t.Error("expected an error for an unrecorded request")
+		}
+	})
+}
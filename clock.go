@@ -0,0 +1,88 @@
+package retryable
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock tells the time, and waits, on behalf of a client. It's a seam for tests,
+// which may swap in a fake clock so that schedules and time limits can be checked
+// without anything actually sleeping
+type Clock interface {
+	Now() time.Time
+
+	// Sleep blocks for d, or until ctx is done, in which case it returns the cause
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+// realClock is the Clock of the wall, and of time.Sleep
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// clock returns the Clock calls through this client should use
+func (h HttpClient) clock() Clock {
+	if h.Clock != nil {
+		return h.Clock
+	}
+
+	return realClock{}
+}
+
+// TestClock is a Clock for tests, whose time only moves when told to. Sleeps
+// return at once, having moved the clock on by however long they were for, such
+// that schedules and time limits play out in full without any real waiting. It is
+// safe for concurrent use
+type TestClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewTestClock returns a TestClock which starts at start
+func NewTestClock(start time.Time) *TestClock {
+	return &TestClock{now: start}
+}
+
+// Now implements the Clock interface
+func (c *TestClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// Sleep implements the Clock interface, moving the clock on by d, unless ctx is
+// already done
+func (c *TestClock) Sleep(ctx context.Context, d time.Duration) error {
+	err := context.Cause(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.Advance(d)
+
+	return nil
+}
+
+// Advance moves the clock on by d
+func (c *TestClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
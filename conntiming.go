@@ -0,0 +1,85 @@
+package retryable
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// ConnTiming breaks down where the time went when making a request. Phases which
+// didn't happen, such as DNS lookups on a reused connection, are left as zero
+type ConnTiming struct {
+	DNSLookup       time.Duration
+	TCPConnect      time.Duration
+	TLSHandshake    time.Duration
+	TimeToFirstByte time.Duration
+}
+
+// connTracer collects a ConnTiming via httptrace. Trace hooks may be called
+// from whichever goroutine net/http happens to be running, hence the lock
+type connTracer struct {
+	mu sync.Mutex
+
+	start, dnsStart, connectStart, tlsStart time.Time
+	timing                                  ConnTiming
+}
+
+// trace returns a copy of req which reports to t
+func (t *connTracer) trace(req *http.Request) *http.Request {
+	t.start = time.Now()
+
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+
+			t.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+
+			t.timing.DNSLookup = time.Since(t.dnsStart)
+		},
+		ConnectStart: func(string, string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+
+			t.connectStart = time.Now()
+		},
+		ConnectDone: func(string, string, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+
+			t.timing.TCPConnect = time.Since(t.connectStart)
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+
+			t.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+
+			t.timing.TLSHandshake = time.Since(t.tlsStart)
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+
+			t.timing.TimeToFirstByte = time.Since(t.start)
+		},
+	}))
+}
+
+// result returns the timings collected so far
+func (t *connTracer) result() ConnTiming {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.timing
+}
@@ -2,6 +2,10 @@ package retryable
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync/atomic"
 	"time"
 )
 
@@ -9,16 +13,100 @@ import (
 // pass metadata around
 type requestMetadata struct {
 	requests           int
+	successfulAttempt  int
 	successfulDuration time.Duration
+	terminationReason  Reason
+	connTiming         ConnTiming
+	capturedHeaders    http.Header
+	errorBody          []byte
+	backoffStrategy    string
+	trace              []AttemptRecord
+	hitRateLimit       bool
+	stale              bool
+	errorAsSuccess     error
+	retryAfterWaited   time.Duration
+
+	// These are updated as bodies are read, which may well be after DoWithContext
+	// has returned, and so need to be safe for concurrent use
+	bytesSent     atomic.Int64
+	bytesReceived atomic.Int64
+}
+
+// Reason describes why a call to DoWithContext stopped making attempts
+type Reason int
+
+const (
+	// ReasonSuccess means an attempt succeeded
+	ReasonSuccess Reason = iota
+
+	// ReasonMaxRetries means every allowed attempt failed
+	ReasonMaxRetries
+
+	// ReasonMaxElapsed means MaxElapsedTime would have been exceeded by retrying again
+	ReasonMaxElapsed
+
+	// ReasonPermanent means an attempt failed in a way retrying won't fix, such as
+	// a 4xx response
+	ReasonPermanent
+
+	// ReasonContextCancelled means the context passed to DoWithContext was cancelled,
+	// or hit its deadline, between attempts
+	ReasonContextCancelled
+
+	// ReasonMaxBackoffTotal means waiting for another attempt would have exceeded
+	// MaxBackoffTotal
+	ReasonMaxBackoffTotal
+
+	// ReasonServerDeadline means the next attempt would have come after the deadline
+	// set by the server via HttpClient.DeadlineHeader
+	ReasonServerDeadline
+)
+
+// String implements the fmt.Stringer interface
+func (r Reason) String() string {
+	switch r {
+	case ReasonSuccess:
+		return "success"
+	case ReasonMaxRetries:
+		return "max retries"
+	case ReasonMaxElapsed:
+		return "max elapsed time"
+	case ReasonPermanent:
+		return "permanent error"
+	case ReasonContextCancelled:
+		return "context cancelled"
+	case ReasonMaxBackoffTotal:
+		return "max backoff total"
+	case ReasonServerDeadline:
+		return "server deadline"
+	}
+
+	return fmt.Sprintf("Reason(%d)", int(r))
 }
 
 // httpRequestMetadataContextKey is used to key metadata within request contexts
 type httpRequestMetadataContextKey struct{}
 
+// maxRetriesContextKey is used to key per-call MaxRetries overrides within contexts
+type maxRetriesContextKey struct{}
+
+// successPredicateContextKey is used to key per-call SuccessPredicate overrides
+// within contexts
+type successPredicateContextKey struct{}
+
+// operationContextKey is used to key operation names within contexts
+type operationContextKey struct{}
+
 // NewContext returns a context.Context preseeded for DoWithContext use,
 // with handy things such as metadata keys pre-created
 func NewContext() context.Context {
-	return context.WithValue(context.Background(), httpRequestMetadataContextKey{}, new(requestMetadata))
+	return ContextWithMetadata(context.Background())
+}
+
+// ContextWithMetadata is as NewContext, but derives the returned context from ctx,
+// keeping its deadline, cancellation, and values
+func ContextWithMetadata(ctx context.Context) context.Context {
+	return context.WithValue(ctx, httpRequestMetadataContextKey{}, new(requestMetadata))
 }
 
 func getRequestMetadata(ctx context.Context) (*requestMetadata, bool) {
@@ -40,6 +128,18 @@ func NumberOfAttemptsFromContext(ctx context.Context) (int, bool) {
 	return md.requests, true
 }
 
+// SuccessfulAttemptFromContext may be used to return the attempt on which the httpClient
+// got a successful response which, unlike NumberOfAttemptsFromContext, is only reported
+// for calls which succeeded
+func SuccessfulAttemptFromContext(ctx context.Context) (int, bool) {
+	md, ok := getRequestMetadata(ctx)
+	if !ok || md.successfulAttempt == 0 {
+		return 0, false
+	}
+
+	return md.successfulAttempt, true
+}
+
 // SuccessfulRequestDurationFromContext may be used to return the duration the upload to
 // DexoryView took, should there have been a successful request
 func SuccessfulRequestDurationFromContext(ctx context.Context) (time.Duration, bool) {
@@ -50,3 +150,183 @@ func SuccessfulRequestDurationFromContext(ctx context.Context) (time.Duration, b
 
 	return md.successfulDuration, true
 }
+
+// TerminationReasonFromContext may be used to return the reason the httpClient stopped
+// making attempts; whether it succeeded, or otherwise ran out of attempts, time, and so on
+func TerminationReasonFromContext(ctx context.Context) (Reason, bool) {
+	md, ok := getRequestMetadata(ctx)
+	if !ok {
+		return 0, false
+	}
+
+	return md.terminationReason, true
+}
+
+// BackoffStrategyFromContext may be used to return the name of the backoff strategy
+// used between attempts, such as "full jitter", for correlating timings with config
+func BackoffStrategyFromContext(ctx context.Context) (string, bool) {
+	md, ok := getRequestMetadata(ctx)
+	if !ok {
+		return "", false
+	}
+
+	return md.backoffStrategy, true
+}
+
+// HitRateLimitFromContext may be used to return whether any attempt made by a call
+// was rate limited with a 429, whether or not the call went on to succeed
+func HitRateLimitFromContext(ctx context.Context) (bool, bool) {
+	md, ok := getRequestMetadata(ctx)
+	if !ok {
+		return false, false
+	}
+
+	return md.hitRateLimit, true
+}
+
+// StaleFromContext may be used to return whether a call failed, and returned a stale
+// response from HttpClient.Cache in place of an error, as per StaleOnError
+func StaleFromContext(ctx context.Context) (bool, bool) {
+	md, ok := getRequestMetadata(ctx)
+	if !ok {
+		return false, false
+	}
+
+	return md.stale, true
+}
+
+// RetryAfterWaitedFromContext may be used to return the most recent delay a call
+// waited for at the server's behest, as with a Retry-After header (or, for a 429
+// without one, the default wait), rather than by its own backoff. It's 0 where the
+// server never had a say.
+//
+// Comparing this with the call's duration shows how much of its latency was down
+// to throttling
+func RetryAfterWaitedFromContext(ctx context.Context) (time.Duration, bool) {
+	md, ok := getRequestMetadata(ctx)
+	if !ok {
+		return 0, false
+	}
+
+	return md.retryAfterWaited, true
+}
+
+// ErrorAsSuccessFromContext may be used to return the error which a call took as a
+// success, as per HttpClient.SuccessOnError. It's nil where the call did no such
+// thing, or where ctx holds no metadata
+func ErrorAsSuccessFromContext(ctx context.Context) error {
+	md, ok := getRequestMetadata(ctx)
+	if !ok {
+		return nil
+	}
+
+	return md.errorAsSuccess
+}
+
+// ConnectionTimingFromContext may be used to return a breakdown of the connection-level
+// timings of the successful request, should HttpClient.TraceConnections be set
+func ConnectionTimingFromContext(ctx context.Context) (ConnTiming, bool) {
+	md, ok := getRequestMetadata(ctx)
+	if !ok {
+		return ConnTiming{}, false
+	}
+
+	return md.connTiming, true
+}
+
+// CapturedHeadersFromContext may be used to return the headers listed in
+// HttpClient.CaptureHeaders, as found on the final response. The returned header is
+// nil should the final attempt not have received a response at all
+func CapturedHeadersFromContext(ctx context.Context) (http.Header, bool) {
+	md, ok := getRequestMetadata(ctx)
+	if !ok {
+		return nil, false
+	}
+
+	return md.capturedHeaders, true
+}
+
+// ErrorBodyFromContext may be used to return the start of the body of the final
+// response of a failed call, should HttpClient.CaptureErrorBody be set. The returned
+// body is nil where the call succeeded, or failed without a response
+func ErrorBodyFromContext(ctx context.Context) ([]byte, bool) {
+	md, ok := getRequestMetadata(ctx)
+	if !ok {
+		return nil, false
+	}
+
+	return md.errorBody, true
+}
+
+// TraceFromContext may be used to return a record of every attempt made by a call,
+// should HttpClient.Trace be set. The records are suitable for logging as JSON
+func TraceFromContext(ctx context.Context) ([]AttemptRecord, bool) {
+	md, ok := getRequestMetadata(ctx)
+	if !ok {
+		return nil, false
+	}
+
+	return slices.Clone(md.trace), true
+}
+
+// ContextWithMaxRetries returns a copy of ctx which overrides HttpClient.MaxRetries
+// for calls to DoWithContext made with it. This allows a single call on a shared
+// client to try harder (or less hard) than the rest, without mutating the client.
+//
+// The override takes precedence over both HttpClient.MaxRetries and
+// HttpClient.MaxAttempts. As with MaxRetries, 0 means retries are limited only
+// by MaxElapsedTime
+func ContextWithMaxRetries(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, maxRetriesContextKey{}, n)
+}
+
+func getMaxRetries(ctx context.Context) (int, bool) {
+	n, ok := ctx.Value(maxRetriesContextKey{}).(int)
+
+	return n, ok
+}
+
+// ContextWithSuccessPredicate returns a copy of ctx which overrides
+// HttpClient.SuccessPredicate for calls to DoWithContext made with it. This allows
+// a single call on a shared client to judge success differently to the rest (such
+// as a poll which should keep going on a 202), without mutating the client
+func ContextWithSuccessPredicate(ctx context.Context, fn func(resp *http.Response) bool) context.Context {
+	return context.WithValue(ctx, successPredicateContextKey{}, fn)
+}
+
+func getSuccessPredicate(ctx context.Context) (func(resp *http.Response) bool, bool) {
+	fn, ok := ctx.Value(successPredicateContextKey{}).(func(resp *http.Response) bool)
+
+	return fn, ok && fn != nil
+}
+
+// TransferStatsFromContext may be used to return the number of bytes sent and received
+// by a call. See TransferStats for what is, and isn't, counted
+func TransferStatsFromContext(ctx context.Context) (TransferStats, bool) {
+	md, ok := getRequestMetadata(ctx)
+	if !ok {
+		return TransferStats{}, false
+	}
+
+	return TransferStats{
+		BytesSent:     md.bytesSent.Load(),
+		BytesReceived: md.bytesReceived.Load(),
+	}, true
+}
+
+// ContextWithOperation returns a copy of ctx tagged with the name of the logical
+// operation being performed, such as "upload-scan" or "fetch-config", so that calls
+// made through a single shared client can be told apart.
+//
+// Anything handed the context of a call, such as a Limiter, may retrieve the name
+// with OperationFromContext
+func ContextWithOperation(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, operationContextKey{}, name)
+}
+
+// OperationFromContext returns the operation name set with ContextWithOperation
+func OperationFromContext(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(operationContextKey{}).(string)
+
+	return name, ok
+}
@@ -0,0 +1,56 @@
+package retryable
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// DoAndDecode makes req with c.DoWithContext and decodes the JSON body of the
+// response into a T, closing the body as it goes.
+//
+// Responses without a 2xx status return an UnexpectedStatusError, whether
+// DoWithContext let them through (such as where SuccessStatusRange has been
+// widened) or gave up on them; in which case its error is wrapped. Whatever the
+// error, the zero T is returned alongside it. So too where SuccessOnError took an
+// error as success, leaving no body to decode, albeit with a nil error
+func DoAndDecode[T any](ctx context.Context, c *HttpClient, req *http.Request) (T, error) {
+	var v T
+
+	resp, err := c.DoWithContext(ctx, req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+
+	if resp != nil && resp.StatusCode/100 != 2 {
+		return v, unexpectedStatus(resp, err)
+	}
+
+	if err != nil || resp == nil {
+		return v, err
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&v)
+	if err != nil {
+		var zero T
+
+		return zero, err
+	}
+
+	return v, nil
+}
+
+// unexpectedStatus returns an UnexpectedStatusError for resp, holding the start of
+// its body, which is drained so that the connection may be reused
+func unexpectedStatus(resp *http.Response, err error) UnexpectedStatusError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, int64(errorBodySnippetLength)))
+	_, _ = io.CopyN(io.Discard, resp.Body, maxDrainBytes)
+
+	return UnexpectedStatusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       body,
+		Err:        err,
+	}
+}
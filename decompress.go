@@ -0,0 +1,88 @@
+package retryable
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Decoder wraps a compressed body, returning a reader of its decompressed contents
+type Decoder func(r io.Reader) (io.ReadCloser, error)
+
+// defaultDecoders are the content encodings understood by AutoDecompress out of
+// the box; others may be added with Decoders, as the decompress package does for
+// br and zstd
+var defaultDecoders = map[string]Decoder{
+	"gzip": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+
+	// HTTP's deflate is, confusingly, zlib
+	"deflate": func(r io.Reader) (io.ReadCloser, error) {
+		return zlib.NewReader(r)
+	},
+}
+
+// decoders returns every Decoder available to the client, keyed by content
+// encoding
+func (h HttpClient) decoders() map[string]Decoder {
+	d := maps.Clone(defaultDecoders)
+	maps.Copy(d, h.Decoders)
+
+	return d
+}
+
+// acceptEncoding returns an Accept-Encoding header value listing every encoding
+// the client can decompress
+func (h HttpClient) acceptEncoding() string {
+	return strings.Join(slices.Sorted(maps.Keys(h.decoders())), ", ")
+}
+
+// decompress replaces resp's body with its decompressed contents, where it's
+// compressed with a known encoding. Anything else is left untouched
+func (h HttpClient) decompress(resp *http.Response) error {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+
+	decode, ok := h.decoders()[encoding]
+	if !ok || resp.Body == nil || resp.Body == http.NoBody {
+		return nil
+	}
+
+	r, err := decode(resp.Body)
+	if err != nil {
+		_ = resp.Body.Close()
+
+		return err
+	}
+
+	resp.Body = decodedBody{ReadCloser: r, compressed: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+
+	return nil
+}
+
+// decodedBody closes both the decoder and the compressed body it reads from
+type decodedBody struct {
+	io.ReadCloser
+
+	compressed io.Closer
+}
+
+// Close implements io.Closer
+func (b decodedBody) Close() error {
+	err := b.ReadCloser.Close()
+
+	cerr := b.compressed.Close()
+	if err == nil {
+		err = cerr
+	}
+
+	return err
+}
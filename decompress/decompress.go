@@ -0,0 +1,66 @@
+// Package decompress provides retryable.Decoders for the br (Brotli) and zstd
+// (Zstandard) content encodings, which AutoDecompress doesn't support out of the
+// box. It's a module of its own, apart from retryable, so that only those who
+// import it depend on the compression libraries it uses.
+//
+//	c := retryable.New(decompress.WithDecoders())
+//
+// Or, to add them to a client by hand:
+//
+//	c.AutoDecompress = true
+//	c.Decoders = decompress.Decoders()
+package decompress
+
+import (
+	"io"
+	"maps"
+
+	"github.com/andybalholm/brotli"
+	"github.com/botsandus/retryable"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	_ retryable.Decoder = Brotli
+	_ retryable.Decoder = Zstd
+)
+
+// Brotli is a retryable.Decoder for the br content encoding
+func Brotli(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(brotli.NewReader(r)), nil
+}
+
+// Zstd is a retryable.Decoder for the zstd content encoding
+func Zstd(r io.Reader) (io.ReadCloser, error) {
+	// Bodies are decoded one at a time, as they're read, so there's no call for
+	// the decoder's background goroutines
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+
+	return d.IOReadCloser(), nil
+}
+
+// Decoders returns the br and zstd decoders, keyed by content encoding, ready for
+// HttpClient.Decoders
+func Decoders() map[string]retryable.Decoder {
+	return map[string]retryable.Decoder{
+		"br":   Brotli,
+		"zstd": Zstd,
+	}
+}
+
+// WithDecoders turns on AutoDecompress, adding the br and zstd decoders to any the
+// client already has
+func WithDecoders() retryable.Option {
+	return func(h *retryable.HttpClient) {
+		h.AutoDecompress = true
+
+		if h.Decoders == nil {
+			h.Decoders = make(map[string]retryable.Decoder)
+		}
+
+		maps.Copy(h.Decoders, Decoders())
+	}
+}
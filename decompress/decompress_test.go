@@ -0,0 +1,90 @@
+package decompress_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/botsandus/retryable"
+	"github.com/botsandus/retryable/decompress"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestWithDecoders(t *testing.T) {
+	const payload = `{"result": 42}`
+
+	for _, test := range []struct {
+		name     string
+		encoding string
+		compress func(t *testing.T, b []byte) []byte
+	}{
+		{"Brotli", "br", func(t *testing.T, b []byte) []byte {
+			buf := new(bytes.Buffer)
+
+			w := brotli.NewWriter(buf)
+			_, _ = w.Write(b)
+
+			err := w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return buf.Bytes()
+		}},
+		{"Zstandard", "zstd", func(t *testing.T, b []byte) []byte {
+			w, err := zstd.NewWriter(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer w.Close()
+
+			return w.EncodeAll(b, nil)
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			body := test.compress(t, []byte(payload))
+
+			var accepted string
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				accepted = r.Header.Get("Accept-Encoding")
+
+				w.Header().Set("Content-Encoding", test.encoding)
+				_, _ = w.Write(body)
+			}))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.New(retryable.WithInstantBackoff(), decompress.WithDecoders())
+
+			resp, err := c.DoWithContext(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer resp.Body.Close()
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(b) != payload {
+				t.Errorf("expected %q, received %q", payload, b)
+			}
+
+			if expect := "br, deflate, gzip, zstd"; accepted != expect {
+				t.Errorf("expected Accept-Encoding %q, received %q", expect, accepted)
+			}
+		})
+	}
+}
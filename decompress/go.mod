@@ -0,0 +1,14 @@
+module github.com/botsandus/retryable/decompress
+
+go 1.23
+
+require (
+	github.com/andybalholm/brotli v1.2.0
+	github.com/botsandus/retryable v0.0.0-20261016105126-de180f8b91b0
+	github.com/klauspost/compress v1.18.0
+)
+
+require (
+	github.com/cenkalti/backoff/v5 v5.0.3 // indirect
+	golang.org/x/sync v0.10.0 // indirect
+)
@@ -0,0 +1,74 @@
+package retryable
+
+import (
+	"math/rand/v2"
+	"net/url"
+)
+
+// Endpoint is one of the backends in an EndpointPool, which is picked in proportion
+// to its Weight. Endpoints with a Weight of 0 or less are never picked
+type Endpoint struct {
+	URL    *url.URL
+	Weight int
+}
+
+// EndpointPool spreads attempts across a set of backends, picking one at random,
+// weighted by their weights, for each attempt. Healthier or bigger backends may be
+// given more weight, and so more of the attempts.
+//
+// Endpoints mustn't be changed while the pool is in use
+type EndpointPool struct {
+	Endpoints []Endpoint
+}
+
+// NewEndpointPool returns an EndpointPool of endpoints
+func NewEndpointPool(endpoints ...Endpoint) *EndpointPool {
+	return &EndpointPool{Endpoints: endpoints}
+}
+
+// Pick returns the URL of an endpoint picked at random, weighted by the endpoints'
+// weights, or nil where there's nothing to pick
+func (p *EndpointPool) Pick() *url.URL {
+	return p.pick(rand.Float64()) // #nosec G404 -- load balancing needn't be cryptographically secure
+}
+
+// pick returns the URL of the endpoint at r, a number in [0.0,1.0), of the way
+// through the pool's total weight
+func (p *EndpointPool) pick(r float64) *url.URL {
+	var total int
+	for _, e := range p.Endpoints {
+		total += max(e.Weight, 0)
+	}
+
+	if total == 0 {
+		return nil
+	}
+
+	n := int(r * float64(total))
+
+	var last *url.URL
+	for _, e := range p.Endpoints {
+		if e.Weight <= 0 {
+			continue
+		}
+
+		if n < e.Weight {
+			return e.URL
+		}
+
+		n -= e.Weight
+		last = e.URL
+	}
+
+	// Only reachable through floating point rounding
+	return last
+}
+
+// withEndpoint returns a copy of u, sent to the scheme and host of endpoint instead
+func withEndpoint(u, endpoint *url.URL) *url.URL {
+	c := *u
+	c.Scheme = endpoint.Scheme
+	c.Host = endpoint.Host
+
+	return &c
+}
@@ -0,0 +1,37 @@
+package retryable
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestEndpointPool_pick(t *testing.T) {
+	a, _ := url.Parse("http://a.example.com")
+	b, _ := url.Parse("http://b.example.com")
+	c, _ := url.Parse("http://c.example.com")
+
+	p := NewEndpointPool(
+		Endpoint{URL: a, Weight: 1},
+		Endpoint{URL: b, Weight: 0},
+		Endpoint{URL: c, Weight: 3},
+	)
+
+	for _, test := range []struct {
+		r      float64
+		expect *url.URL
+	}{
+		{0, a},
+		{0.24, a},
+		{0.25, c},
+		{0.99, c},
+		{0.9999999999999999, c},
+	} {
+		if u := p.pick(test.r); test.expect != u {
+			t.Errorf("%v: expected %v, received %v", test.r, test.expect, u)
+		}
+	}
+
+	if u := NewEndpointPool(Endpoint{URL: b}).pick(0.5); u != nil {
+		t.Errorf("expected nil from a weightless pool, received %v", u)
+	}
+}
@@ -0,0 +1,57 @@
+package retryable
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// The environment variables read by NewFromEnv
+const (
+	EnvMaxRetries     = "RETRYABLE_MAX_RETRIES"
+	EnvMaxInterval    = "RETRYABLE_MAX_INTERVAL"
+	EnvMaxElapsedTime = "RETRYABLE_MAX_ELAPSED_TIME"
+)
+
+// NewFromEnv returns an HttpClient configured from the environment, falling back
+// to the defaults from New for anything unset.
+//
+// RETRYABLE_MAX_RETRIES is an integer, while RETRYABLE_MAX_INTERVAL and
+// RETRYABLE_MAX_ELAPSED_TIME are durations, as understood by time.ParseDuration
+// (such as "30s" or "5m"). Malformed or negative values are returned as errors,
+// rather than quietly ignored
+func NewFromEnv() (*HttpClient, error) {
+	c := New()
+
+	if v, ok := os.LookupEnv(EnvMaxRetries); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s: invalid value %q", EnvMaxRetries, v)
+		}
+
+		c.MaxRetries = n
+	}
+
+	for _, d := range []struct {
+		env   string
+		field *time.Duration
+	}{
+		{EnvMaxInterval, &c.MaxInterval},
+		{EnvMaxElapsedTime, &c.MaxElapsedTime},
+	} {
+		v, ok := os.LookupEnv(d.env)
+		if !ok {
+			continue
+		}
+
+		dur, err := time.ParseDuration(v)
+		if err != nil || dur < 0 {
+			return nil, fmt.Errorf("%s: invalid value %q", d.env, v)
+		}
+
+		*d.field = dur
+	}
+
+	return c, nil
+}
@@ -0,0 +1,61 @@
+package retryable_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/botsandus/retryable"
+)
+
+func TestNewFromEnv(t *testing.T) {
+	for _, test := range []struct {
+		name              string
+		env               map[string]string
+		expectError       bool
+		expectRetries     int
+		expectInterval    time.Duration
+		expectElapsedTime time.Duration
+	}{
+		{"Defaults", nil, false, 9, 30 * time.Second, 0},
+		{"Everything set", map[string]string{
+			retryable.EnvMaxRetries:     "3",
+			retryable.EnvMaxInterval:    "5s",
+			retryable.EnvMaxElapsedTime: "2m",
+		}, false, 3, 5 * time.Second, 2 * time.Minute},
+		{"Malformed retries", map[string]string{retryable.EnvMaxRetries: "lots"}, true, 0, 0, 0},
+		{"Negative retries", map[string]string{retryable.EnvMaxRetries: "-1"}, true, 0, 0, 0},
+		{"Malformed interval", map[string]string{retryable.EnvMaxInterval: "5"}, true, 0, 0, 0},
+		{"Negative elapsed time", map[string]string{retryable.EnvMaxElapsedTime: "-1s"}, true, 0, 0, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for k, v := range test.env {
+				t.Setenv(k, v)
+			}
+
+			c, err := retryable.NewFromEnv()
+			if test.expectError {
+				if err == nil {
+					t.Error("expected an error")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.expectRetries != c.MaxRetries {
+				t.Errorf("expected %d retries, received %d", test.expectRetries, c.MaxRetries)
+			}
+
+			if test.expectInterval != c.MaxInterval {
+				t.Errorf("expected interval %s, received %s", test.expectInterval, c.MaxInterval)
+			}
+
+			if test.expectElapsedTime != c.MaxElapsedTime {
+				t.Errorf("expected elapsed time %s, received %s", test.expectElapsedTime, c.MaxElapsedTime)
+			}
+		})
+	}
+}
@@ -1,6 +1,15 @@
 package retryable
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrMaxAttempts matches, via errors.Is, the error returned by calls which ran out
+// of attempts, as opposed to those which ran out of time (which instead match
+// context.DeadlineExceeded)
+var ErrMaxAttempts = errors.New("max attempts reached")
 
 // MaxAttemptsReachedError is returned, unsurprisingly, when we've attempted to make
 // a request too many times, and none have been successful
@@ -12,3 +21,87 @@ type MaxAttemptsReachedError struct {
 func (e MaxAttemptsReachedError) Error() string {
 	return fmt.Sprintf("Request failed %d times", e.c)
 }
+
+// Is allows errors.Is(err, ErrMaxAttempts) to match
+func (e MaxAttemptsReachedError) Is(target error) bool {
+	return target == ErrMaxAttempts
+}
+
+// GRPCStatusError is returned when a response tunnelling gRPC carries a non-OK
+// grpc-status header
+type GRPCStatusError struct {
+	Code    int
+	Message string
+}
+
+// Error implements the `Error` interface
+func (e GRPCStatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("grpc-status %d", e.Code)
+	}
+
+	return fmt.Sprintf("grpc-status %d: %s", e.Code, e.Message)
+}
+
+// TruncatedBodyError is returned when reading a response body which ends before
+// the number of bytes promised by its Content-Length
+type TruncatedBodyError struct {
+	Expected, Received int64
+}
+
+// Error implements the `Error` interface
+func (e TruncatedBodyError) Error() string {
+	return fmt.Sprintf("response body truncated: expected %d bytes, received %d", e.Expected, e.Received)
+}
+
+// Unwrap allows errors.Is(err, io.ErrUnexpectedEOF) to match
+func (e TruncatedBodyError) Unwrap() error {
+	return io.ErrUnexpectedEOF
+}
+
+// RequestQuotaExceededError is returned once a client has made all of the requests
+// allowed by HttpClient.MaxTotalRequests
+type RequestQuotaExceededError struct {
+	Limit int64
+}
+
+// Error implements the `Error` interface
+func (e RequestQuotaExceededError) Error() string {
+	return fmt.Sprintf("request quota of %d exceeded", e.Limit)
+}
+
+// UnexpectedStatusError is returned by DoAndDecode for responses without a 2xx
+// status, be they let through by DoWithContext or the last of a failed call. Body
+// holds the start of the response body, and Err the error DoWithContext returned,
+// if any
+type UnexpectedStatusError struct {
+	StatusCode int
+	Status     string
+	Body       []byte
+	Err        error
+}
+
+// Error implements the `Error` interface
+func (e UnexpectedStatusError) Error() string {
+	if len(e.Body) == 0 {
+		return fmt.Sprintf("unexpected status %s", e.Status)
+	}
+
+	return fmt.Sprintf("unexpected status %s: %s", e.Status, e.Body)
+}
+
+// Unwrap returns the error DoWithContext returned alongside the response
+func (e UnexpectedStatusError) Unwrap() error {
+	return e.Err
+}
+
+// BodyTooLargeError is returned by NewRequestLimited for bodies larger than it's
+// allowed to buffer
+type BodyTooLargeError struct {
+	Limit int64
+}
+
+// Error implements the `Error` interface
+func (e BodyTooLargeError) Error() string {
+	return fmt.Sprintf("request body exceeds %d bytes", e.Limit)
+}
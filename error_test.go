@@ -1,6 +1,10 @@
 package retryable
 
-import "testing"
+import (
+	"errors"
+	"io"
+	"testing"
+)
 
 func TestMaxAttemptsReachedError(t *testing.T) {
 	err := MaxAttemptsReachedError{c: 99}
@@ -9,4 +13,62 @@ func TestMaxAttemptsReachedError(t *testing.T) {
 	if expect != err.Error() {
 		t.Errorf("expected %q, received %q", expect, err.Error())
 	}
+
+	if !errors.Is(err, ErrMaxAttempts) {
+		t.Errorf("expected %v to match ErrMaxAttempts", err)
+	}
+}
+
+func TestGRPCStatusError(t *testing.T) {
+	for _, test := range []struct {
+		err    GRPCStatusError
+		expect string
+	}{
+		{GRPCStatusError{Code: 14}, "grpc-status 14"},
+		{GRPCStatusError{Code: 3, Message: "bad field"}, "grpc-status 3: bad field"},
+	} {
+		if test.expect != test.err.Error() {
+			t.Errorf("expected %q, received %q", test.expect, test.err.Error())
+		}
+	}
+}
+
+func TestTruncatedBodyError(t *testing.T) {
+	err := TruncatedBodyError{Expected: 10, Received: 4}
+	expect := "response body truncated: expected 10 bytes, received 4"
+
+	if expect != err.Error() {
+		t.Errorf("expected %q, received %q", expect, err.Error())
+	}
+
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("expected TruncatedBodyError to be an io.ErrUnexpectedEOF")
+	}
+}
+
+func TestRequestQuotaExceededError(t *testing.T) {
+	err := RequestQuotaExceededError{Limit: 5}
+	expect := "request quota of 5 exceeded"
+
+	if expect != err.Error() {
+		t.Errorf("expected %q, received %q", expect, err.Error())
+	}
+}
+
+func TestUnexpectedStatusError(t *testing.T) {
+	err := UnexpectedStatusError{StatusCode: 302, Status: "302 Found"}
+	expect := "unexpected status 302 Found"
+
+	if expect != err.Error() {
+		t.Errorf("expected %q, received %q", expect, err.Error())
+	}
+}
+
+func TestBodyTooLargeError(t *testing.T) {
+	err := BodyTooLargeError{Limit: 1024}
+	expect := "request body exceeds 1024 bytes"
+
+	if expect != err.Error() {
+		t.Errorf("expected %q, received %q", expect, err.Error())
+	}
 }
@@ -0,0 +1,86 @@
+package retryable
+
+import "time"
+
+// subscriberBuffer is the number of events buffered per subscriber before
+// further events are dropped
+const subscriberBuffer = 64
+
+// RetryEvent describes a failed attempt which is about to be retried
+type RetryEvent struct {
+	Host    string
+	Attempt int
+
+	// URL is where the failed attempt was actually sent, which differs from the
+	// request's own URL where endpoints are rewritten, or redirects followed
+	URL string
+
+	// Operation is the name given to the call with ContextWithOperation, if any
+	Operation string
+
+	// Status is the status code of the failed attempt, or 0 where the attempt
+	// failed without a response
+	Status int
+
+	// Delay is how long we'll wait before the next attempt
+	Delay time.Duration
+	Err   error
+}
+
+// Subscribe returns a channel which receives a RetryEvent for every retry made by
+// any call through this client, which is handy for live monitoring.
+//
+// Events are buffered, but should a subscriber fall too far behind further events
+// are dropped rather than allowed to hold up requests. Subscribers should call
+// Unsubscribe when they're done.
+//
+// Clients not created with New (or friends) must not call Subscribe while calls
+// are in flight
+func (h *HttpClient) Subscribe() <-chan RetryEvent {
+	if h.state == nil {
+		h.state = newClientState()
+	}
+
+	ch := make(chan RetryEvent, subscriberBuffer)
+
+	h.state.mu.Lock()
+	defer h.state.mu.Unlock()
+
+	h.state.subscribers[ch] = struct{}{}
+
+	return ch
+}
+
+// Unsubscribe stops and closes a channel returned by Subscribe
+func (h *HttpClient) Unsubscribe(ch <-chan RetryEvent) {
+	if h.state == nil {
+		return
+	}
+
+	h.state.mu.Lock()
+	defer h.state.mu.Unlock()
+
+	for sub := range h.state.subscribers {
+		if (<-chan RetryEvent)(sub) == ch {
+			delete(h.state.subscribers, sub)
+			close(sub)
+		}
+	}
+}
+
+// publish sends ev to every subscriber with room for it
+func (s *clientState) publish(ev RetryEvent) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for sub := range s.subscribers {
+		select {
+		case sub <- ev:
+		default:
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package retryable
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// Result is the outcome of a single request made by DoAll
+type Result struct {
+	Response *http.Response
+	Err      error
+
+	// Attempts is the number of attempts the request took, as per
+	// NumberOfAttemptsFromContext
+	Attempts int
+}
+
+// DoAll makes each of reqs via DoWithContext, concurrently, with at most
+// DoAllWorkers in flight at once, and returns their results in the same order as
+// reqs. Each request gets its own metadata, the attempts from which are returned
+// in its Result.
+//
+// As ever, the caller is responsible for closing the body of each Response
+func (h HttpClient) DoAll(ctx context.Context, reqs []*http.Request) []Result {
+	results := make([]Result, len(reqs))
+
+	workers := h.DoAllWorkers
+	if workers <= 0 || workers > len(reqs) {
+		workers = len(reqs)
+	}
+
+	idx := make(chan int)
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := range idx {
+				md := new(requestMetadata)
+
+				resp, err := h.DoWithContext(context.WithValue(ctx, httpRequestMetadataContextKey{}, md), reqs[i])
+				results[i] = Result{Response: resp, Err: err, Attempts: md.requests}
+			}
+		}()
+	}
+
+	for i := range reqs {
+		idx <- i
+	}
+
+	close(idx)
+	wg.Wait()
+
+	return results
+}
@@ -0,0 +1,156 @@
+// Package faulttransport provides an http.RoundTripper which injects failures
+// according to a script, so that retry configuration can be tested deterministically
+// against the real retryable.HttpClient logic.
+//
+// Plug it in with retryable.NewWithTransport:
+//
+//	ft := faulttransport.New(
+//		faulttransport.Status(http.StatusServiceUnavailable),
+//		faulttransport.Error(faulttransport.ErrConnectionReset),
+//		faulttransport.Pass,
+//	)
+//
+//	c := retryable.NewWithTransport(ft)
+package faulttransport
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// ErrConnectionReset looks, as far as errors.Is is concerned, exactly like the peer
+// resetting a TCP connection
+var ErrConnectionReset error = &net.OpError{
+	Op:  "read",
+	Net: "tcp",
+	Err: os.NewSyscallError("read", syscall.ECONNRESET),
+}
+
+// Outcome describes what should happen to a single request
+type Outcome struct {
+	// StatusCode, when non-zero, is used to synthesise a response with an empty body
+	StatusCode int
+
+	// Header is attached to synthesised responses
+	Header http.Header
+
+	// Err, when set, is returned instead of a response
+	Err error
+}
+
+// Pass lets a request through to the underlying transport untouched
+var Pass = Outcome{}
+
+// Status returns an Outcome which responds with the given status code
+func Status(code int) Outcome {
+	return Outcome{StatusCode: code}
+}
+
+// Error returns an Outcome which fails the request with err
+func Error(err error) Outcome {
+	return Outcome{Err: err}
+}
+
+// Transport is an http.RoundTripper which plays through Script, one Outcome per
+// request. Once the script is exhausted, requests are passed through to Base,
+// unless Repeat is set, in which case the script starts from the top again.
+//
+// Transport is safe for concurrent use, though the order in which concurrent requests
+// are matched against the script is, naturally, up to the scheduler
+type Transport struct {
+	Script []Outcome
+	Repeat bool
+
+	// Base handles requests for which the Outcome is Pass. If nil, http.DefaultTransport
+	// is used
+	Base http.RoundTripper
+
+	mu       sync.Mutex
+	requests int
+}
+
+// New returns a Transport which plays through script once, before passing
+// requests through to http.DefaultTransport
+func New(script ...Outcome) *Transport {
+	return &Transport{Script: script}
+}
+
+// Requests returns the number of requests this Transport has seen
+func (t *Transport) Requests() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.requests
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	o := t.next()
+
+	switch {
+	case o.Err != nil:
+		closeBody(req)
+
+		return nil, o.Err
+
+	case o.StatusCode != 0:
+		closeBody(req)
+
+		header := o.Header.Clone()
+		if header == nil {
+			header = make(http.Header)
+		}
+
+		return &http.Response{
+			Status:     fmt.Sprintf("%d %s", o.StatusCode, http.StatusText(o.StatusCode)),
+			StatusCode: o.StatusCode,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     header,
+			Body:       http.NoBody,
+			Request:    req,
+		}, nil
+	}
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return base.RoundTrip(req)
+}
+
+func (t *Transport) next() Outcome {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := t.requests
+	t.requests++
+
+	if len(t.Script) == 0 {
+		return Pass
+	}
+
+	if t.Repeat {
+		n %= len(t.Script)
+	}
+
+	if n >= len(t.Script) {
+		return Pass
+	}
+
+	return t.Script[n]
+}
+
+// closeBody honours the http.RoundTripper contract, which says we must always
+// close the request body- even on errors
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+}
@@ -0,0 +1,122 @@
+package faulttransport_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/botsandus/retryable"
+	"github.com/botsandus/retryable/faulttransport"
+)
+
+func TestTransport(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	for _, test := range []struct {
+		name           string
+		script         []faulttransport.Outcome
+		repeat         bool
+		expectAttempts int
+		expectError    bool
+	}{
+		{"Empty script passes through", nil, false, 1, false},
+		{"Transient failures are retried", []faulttransport.Outcome{
+			faulttransport.Status(http.StatusServiceUnavailable),
+			faulttransport.Error(faulttransport.ErrConnectionReset),
+		}, false, 3, false},
+		{"Client errors are permanent", []faulttransport.Outcome{
+			faulttransport.Status(http.StatusBadRequest),
+		}, false, 1, true},
+		{"Repeating failures exhaust retries", []faulttransport.Outcome{
+			faulttransport.Status(http.StatusBadGateway),
+		}, true, 4, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ft := faulttransport.New(test.script...)
+			ft.Repeat = test.repeat
+			ft.Base = ts.Client().Transport
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.NewWithTransport(ft)
+			c.MaxInterval = time.Millisecond
+			c.MaxRetries = 3
+
+			ctx := retryable.NewContext()
+
+			_, err = c.DoWithContext(ctx, req)
+			if test.expectError == (err == nil) {
+				t.Errorf("expected error: %v, received %#v", test.expectError, err)
+			}
+
+			attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+			if test.expectAttempts != attempts {
+				t.Errorf("expected %d attempts, received %d", test.expectAttempts, attempts)
+			}
+		})
+	}
+}
+
+// TestTransport_Chaos fails every third request with a 503 and the seventh with a
+// connection reset, checking every call still eventually succeeds
+func TestTransport_Chaos(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	script := make([]faulttransport.Outcome, 21)
+	for i := range script {
+		if (i+1)%3 == 0 {
+			script[i] = faulttransport.Status(http.StatusServiceUnavailable)
+		}
+	}
+
+	script[6] = faulttransport.Error(faulttransport.ErrConnectionReset)
+
+	ft := faulttransport.New(script...)
+	ft.Base = ts.Client().Transport
+
+	c := retryable.NewWithTransport(ft)
+	c.MaxInterval = time.Millisecond
+
+	for i := 0; i < 10; i++ {
+		req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := c.DoWithContext(retryable.NewContext(), req)
+		if err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+
+		_ = resp.Body.Close()
+	}
+
+	if ft.Requests() <= 10 {
+		t.Errorf("expected faults to force retries, but only %d requests were made", ft.Requests())
+	}
+}
+
+func TestErrConnectionReset(t *testing.T) {
+	ft := faulttransport.New(faulttransport.Error(faulttransport.ErrConnectionReset))
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ft.RoundTrip(req)
+	if !errors.Is(err, faulttransport.ErrConnectionReset) {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
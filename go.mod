@@ -2,4 +2,8 @@ module github.com/botsandus/retryable
 
 go 1.23
 
-require github.com/cenkalti/backoff/v5 v5.0.3
+require (
+	github.com/cenkalti/backoff/v5 v5.0.3
+	golang.org/x/sync v0.10.0
+	golang.org/x/time v0.8.0
+)
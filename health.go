@@ -0,0 +1,63 @@
+package retryable
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// WaitForHealthy polls url with GET requests, interval apart, until it gets a
+// response which DoWithContext considers successful, or until ctx is done. This
+// suits blocking on a dependency's readiness at startup.
+//
+// Failures which DoWithContext wouldn't retry, such as a 404, are returned
+// straight away, since waiting isn't going to fix them. The client's usual
+// limits on attempts and time don't apply, nor do any per-call MaxRetries from
+// ctx, nor FastFirstRetry or ImmediateRetries; bound the wait with ctx instead.
+// An interval which isn't positive is refused with an error
+func (h *HttpClient) WaitForHealthy(ctx context.Context, url string, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("health check interval must be positive, received %s", interval)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	c := *h
+	c.MaxRetries = 0
+	c.MaxAttempts = 0
+	c.MaxElapsedTime = 0
+	c.MaxBackoffTotal = 0
+	c.FastFirstRetry = false
+	c.ImmediateRetries = 0
+	c.JitterStrategy = NoJitter
+	c.InitialInterval = interval
+	c.MaxInterval = interval
+	c.Multiplier = 1
+
+	// Failed probes are drained and closed as we go, leaving only the last
+	resp, err := c.DoWithContext(ContextWithMaxRetries(ctx, 0), req)
+	if err != nil {
+		discard(resp)
+
+		return err
+	}
+
+	// SuccessOnError may have taken an error as healthy enough
+	if resp == nil {
+		return nil
+	}
+
+	_, err = io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		_ = resp.Body.Close()
+
+		return err
+	}
+
+	return resp.Body.Close()
+}
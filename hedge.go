@@ -0,0 +1,189 @@
+package retryable
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// hedgeResult is the outcome of one of the copies of a request sent by hedge
+type hedgeResult struct {
+	idx  int
+	resp *http.Response
+	err  error
+}
+
+// isIdempotent returns true for methods which rfc9110 defines as idempotent, and
+// which may therefore be sent more than once without fear
+func isIdempotent(method string) bool {
+	switch method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace,
+		http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	return false
+}
+
+// canHedge returns true if the client is configured for hedging, and req is safe to
+// send more than once concurrently
+func (h HttpClient) canHedge(req *http.Request) bool {
+	if h.HedgeDelay <= 0 || h.HedgeCount <= 0 || !isIdempotent(req.Method) {
+		return false
+	}
+
+	// Each copy needs its own body
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// hedge sends req and, should no response arrive within HedgeDelay, sends up to
+// HedgeCount further copies, HedgeDelay apart. The first response back wins and the
+// remaining copies are cancelled.
+//
+// Transport errors don't win races: an error is only returned once every copy
+// has failed. Each further copy counts against MaxTotalRequests, and none are sent
+// once it's used up
+func (h HttpClient) hedge(req *http.Request) (*http.Response, error) {
+	results := make(chan hedgeResult, h.HedgeCount+1)
+	cancels := make([]context.CancelFunc, 0, h.HedgeCount+1)
+
+	launch := func(body io.ReadCloser) {
+		ctx, cancel := context.WithCancel(req.Context())
+
+		r := req.WithContext(ctx)
+		r.Body = body
+
+		idx := len(cancels)
+		cancels = append(cancels, cancel)
+
+		go func() {
+			resp, err := h.httpClient().Do(r)
+			results <- hedgeResult{idx: idx, resp: resp, err: err}
+		}()
+	}
+
+	launch(req.Body)
+
+	timer := time.NewTimer(h.HedgeDelay)
+	defer timer.Stop()
+
+	var (
+		inflight = 1
+		lastErr  error
+		refused  bool
+	)
+
+	// done returns true once no more copies are to be sent
+	done := func() bool {
+		return refused || len(cancels) > h.HedgeCount
+	}
+
+	for {
+		select {
+		case <-timer.C:
+			body, err := rewindBody(req)
+			if err != nil {
+				if inflight == 0 {
+					return nil, err
+				}
+
+				// If we can't get a body, we can't hedge; carry on waiting for what
+				// we already have
+				continue
+			}
+
+			if !h.state.takeRequest(h.MaxTotalRequests) {
+				if body != nil {
+					_ = body.Close()
+				}
+
+				refused = true
+
+				if inflight == 0 {
+					return nil, lastErr
+				}
+
+				continue
+			}
+
+			launch(body)
+			inflight++
+
+			if !done() {
+				timer.Reset(h.HedgeDelay)
+			}
+
+		case res := <-results:
+			inflight--
+
+			if res.err != nil {
+				cancels[res.idx]()
+				lastErr = res.err
+
+				if inflight == 0 && done() {
+					return nil, lastErr
+				}
+
+				if inflight == 0 {
+					// Everything in flight failed; don't hang around waiting for the
+					// timer before trying again
+					timer.Reset(0)
+				}
+
+				continue
+			}
+
+			for i, cancel := range cancels {
+				if i != res.idx {
+					cancel()
+				}
+			}
+
+			go discardHedges(results, inflight)
+
+			res.resp.Body = cancelOnClose{ReadCloser: res.resp.Body, cancel: cancels[res.idx]}
+
+			return res.resp, nil
+		}
+	}
+}
+
+// discardHedges waits for the n losing copies of a hedged request to return,
+// closing any responses they got
+func discardHedges(results chan hedgeResult, n int) {
+	for ; n > 0; n-- {
+		res := <-results
+		if res.resp != nil {
+			_ = res.resp.Body.Close()
+		}
+	}
+}
+
+// rewindBody returns a fresh copy of req's body, or nil where req has no body
+func rewindBody(req *http.Request) (io.ReadCloser, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req.Body, nil
+	}
+
+	if req.GetBody == nil {
+		return nil, fmt.Errorf("%s %s: %w", req.Method, req.URL, ErrBodyNotRewindable)
+	}
+
+	return req.GetBody()
+}
+
+// cancelOnClose cancels a request's context once its response body is closed,
+// which we can't do any sooner without cutting the body off mid-read
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close implements the io.Closer interface
+func (c cancelOnClose) Close() error {
+	defer c.cancel()
+
+	return c.ReadCloser.Close()
+}
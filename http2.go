@@ -0,0 +1,28 @@
+package retryable
+
+import (
+	"regexp"
+)
+
+var (
+	// As with the errors in http_client.go, the HTTP/2 implementation bundled
+	// into net/http keeps its error types to itself, so all we have to go on
+	// are their messages
+	goAwayErrorString        = regexp.MustCompile("http2: server sent GOAWAY")
+	refusedStreamErrorString = regexp.MustCompile("REFUSED_STREAM")
+)
+
+// isUnprocessedError returns true where err shows that an HTTP/2 server turned
+// the request away before doing anything with it, either by refusing its stream
+// outright or by closing the connection with GOAWAY.
+//
+// Such requests provably had no effect, and so are safe to retry whatever their
+// method
+func isUnprocessedError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	return goAwayErrorString.MatchString(err.Error()) ||
+		refusedStreamErrorString.MatchString(err.Error())
+}
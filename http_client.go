@@ -3,9 +3,16 @@ package retryable
 import (
 	"context"
 	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
 	"net/http"
+	"net/url"
 	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	backoff "github.com/cenkalti/backoff/v5"
@@ -20,7 +27,7 @@ var (
 	// request context- so we can't even use string equality checking.
 	//
 	// Thanks Rob Pike
-	redirectErrorString      = regexp.MustCompile("stopped after 10 redirects")
+	redirectErrorString      = regexp.MustCompile(`stopped after \d+ redirects`)
 	untrustedCertErrorString = regexp.MustCompile("certificate is not trusted")
 
 	// default429RetrySeconds is used in the case of 429s that don't set the Retry-After
@@ -28,8 +35,26 @@ var (
 	//
 	// To understand the semantics of the word _may_, please see rfc2119
 	default429RetrySeconds = 1
+
+	// defaultMaxErrorBodyBytes is the most of an error body captured when
+	// MaxErrorBodyBytes isn't set, and errorBodySnippetLength the most of that
+	// which makes it into the error itself
+	defaultMaxErrorBodyBytes int64 = 4096
+	errorBodySnippetLength         = 256
 )
 
+// GatewayStatusCodes returns the statuses typically given by load balancers and
+// proxies which can't reach a healthy backend, as opposed to those given by a
+// backend which was reached, but failed. Each call returns a new slice, which may
+// be changed freely
+func GatewayStatusCodes() []int {
+	return []int{
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+	}
+}
+
 // An HttpClient wraps the default net/http client with a backoff function,
 // allowing for transient failures to be retried
 type HttpClient struct {
@@ -38,16 +63,592 @@ type HttpClient struct {
 	MaxRetries     int
 	MaxInterval    time.Duration
 	MaxElapsedTime time.Duration
+
+	// InitialInterval and Multiplier shape the exponential schedule: the first
+	// retry waits around InitialInterval, with each subsequent wait Multiplier
+	// times longer than the last (up to MaxInterval). Zero values use the backoff
+	// package's defaults, of 500ms and 1.5 respectively
+	InitialInterval time.Duration
+	Multiplier      float64
+
+	// MaxAttempts is the total number of attempts a call may make, including the
+	// first. It's a less confusing alternative to MaxRetries, which doesn't count
+	// the first attempt, and takes precedence over MaxRetries when both are set.
+	//
+	// MaxAttempts of 5 is equivalent to MaxRetries of 4
+	MaxAttempts int
+
+	// MaxBackoffTotal caps the total time spent sleeping between attempts, whereas
+	// MaxElapsedTime also counts the time spent on the requests themselves. This
+	// allows slow requests to take as long as they need, while still bounding how
+	// long we wait around for a struggling server.
+	//
+	// 0 means no cap
+	MaxBackoffTotal time.Duration
+
+	// FastFirstRetry makes the first retry of a call happen after FastFirstRetryDelay
+	// (straight away, by default) whatever the schedule, on the basis that a first
+	// failure is often a momentary blip. Later retries follow the schedule as normal,
+	// starting from InitialInterval
+	FastFirstRetry      bool
+	FastFirstRetryDelay time.Duration
+
+	// ImmediateRetries is how many of a call's retries are made straight away,
+	// before the schedule kicks in from InitialInterval. This is FastFirstRetry for
+	// more than one blip; where both are set, the immediate retries follow the fast
+	// first one.
+	//
+	// Waits asked for by the server, such as with Retry-After, still apply
+	ImmediateRetries int
+
+	// Rand, when set, is used to randomise the intervals between attempts in place
+	// of the global random source, which is handy for reproducing timing-sensitive
+	// bugs. A *rand.Rand isn't safe for concurrent use, so neither is a client with
+	// Rand set
+	Rand *rand.Rand
+
+	// JitterStrategy selects how the intervals between attempts are randomised
+	JitterStrategy JitterStrategy
+
+	// RetryAfterJitter spreads the delays asked for by servers via Retry-After at
+	// random, within [delay, delay*(1+RetryAfterJitter)], so that clients which were
+	// all rate limited at the same moment don't all come back at the same moment,
+	// only to be rate limited again.
+	//
+	// 0 honours Retry-After exactly
+	RetryAfterJitter float64
+
+	// MinRetryAfter and MaxRetryAfter bound the delays asked for by servers via
+	// Retry-After (and the default delay of 429s without one), after any
+	// RetryAfterJitter, guarding against servers which ask us to hammer them, or to
+	// go away for hours. 0 means no bound
+	MinRetryAfter time.Duration
+	MaxRetryAfter time.Duration
+
+	// ExponentialOn429WithoutHeader treats 429s which don't say how long to wait
+	// like any other transient failure, so that they follow (and grow) the usual
+	// exponential schedule. By default such 429s wait a fixed second, and reset the
+	// schedule
+	ExponentialOn429WithoutHeader bool
+
+	// Limiter, when set, is waited on before every attempt
+	Limiter Limiter
+
+	// CaptureHeaders lists response headers to be captured from the final response
+	// of a call, be it successful or not, for use with CapturedHeadersFromContext
+	CaptureHeaders []string
+
+	// SafeToRetryHeader, when set, stops non-idempotent requests (such as POSTs) from
+	// being retried, unless the failed response carries this header with a truthy
+	// value (as understood by strconv.ParseBool), such as `X-Idempotent: true`.
+	//
+	// Failures without a response, such as connection errors, can't carry the
+	// header, and so aren't retried either. The exception is HTTP/2 requests which
+	// the server turned away unprocessed (with GOAWAY or REFUSED_STREAM), which are
+	// always retried
+	SafeToRetryHeader string
+
+	// GRPCStatusRetry, when set, is consulted for otherwise successful responses
+	// which carry a non-zero `grpc-status` header, as is the case when tunnelling
+	// gRPC over HTTP. Returning true retries the request; returning false fails it
+	// permanently.
+	//
+	// Only headers are checked; statuses sent as trailers would require reading
+	// the body, which is left to the caller
+	GRPCStatusRetry func(grpcStatus int) (retry bool)
+
+	// HedgeDelay and HedgeCount enable request hedging for idempotent requests.
+	// Should an attempt not have returned within HedgeDelay, another copy of the
+	// request is sent, up to HedgeCount extra copies, and whichever responds first
+	// is used. The rest are cancelled.
+	//
+	// Requests with a body need a GetBody function (see NewRequest) to be hedged
+	HedgeDelay time.Duration
+	HedgeCount int
+
+	// PerAttemptTimeout bounds each attempt, including the reading of its response
+	// body, separately to the call as a whole. An attempt which times out is retried
+	// like any other failure. 0 means attempts are bounded only by the call's context.
+	//
+	// PerAttemptTimeoutGrowth, where greater than 1, multiplies the timeout for every
+	// attempt after the first (so a growth of 1.5 gives 5s, 7.5s, 11.25s, and so on),
+	// which suits backends which are slow to warm up
+	PerAttemptTimeout       time.Duration
+	PerAttemptTimeoutGrowth float64
+
+	// UploadTimeout and ResponseTimeout bound the two halves of each attempt
+	// separately, which suits large uploads better than PerAttemptTimeout: a slow
+	// upload can be given all the time it needs, without also giving the server that
+	// long to answer.
+	//
+	// UploadTimeout bounds sending the request body, and ResponseTimeout bounds what
+	// comes after, from the end of the upload (or the start of the attempt, for
+	// requests without a body) until the response body is closed. Servers which
+	// answer early stop the upload clock, and start the response one.
+	//
+	// Attempts which run out of either are retried like any other failure, with an
+	// error wrapping ErrUploadTimeout or ErrResponseTimeout. 0 means no bound, and
+	// either may be used alongside PerAttemptTimeout
+	UploadTimeout   time.Duration
+	ResponseTimeout time.Duration
+
+	// DisableKeepAlives stops connections being reused between requests, so that
+	// every attempt dials afresh (resolving DNS afresh, too). This suits short-lived
+	// tools, which would otherwise leave idle connections behind
+	DisableKeepAlives bool
+
+	// TraceConnections enables the collection of connection-level timings (DNS,
+	// TCP, TLS, and time to first byte) for the successful attempt, available via
+	// ConnectionTimingFromContext
+	TraceConnections bool
+
+	// VerifyContentLength makes reading a successful response body which ends short
+	// of its Content-Length fail with a TruncatedBodyError, rather than ending quietly
+	// with corrupt data.
+	//
+	// Note that truncation is only discovered as the body is read, by which point
+	// DoWithContext has already returned; it's on the caller to make the call again
+	VerifyContentLength bool
+
+	// DoAllWorkers bounds the number of concurrent calls made by DoAll, where 0
+	// means there's no bound
+	DoAllWorkers int
+
+	// HonorRedirectRetryAfter stops 307 and 308 responses which carry a Retry-After
+	// header from being followed. Instead, the original request is retried once the
+	// delay is up, which suits servers which use such redirects to mean "come back
+	// later". Other redirects are followed as normal
+	HonorRedirectRetryAfter bool
+
+	// PreserveMethodOnRedirect keeps the method and body of requests redirected with
+	// a 301 or 302, rather than following them with a GET as net/http does by
+	// default (for historical reasons). 307s and 308s always keep them; 303s, which
+	// mean "GET this instead", never do. Requests with a body need a GetBody
+	// function (see NewRequest), else the redirect fails permanently.
+	//
+	// FollowStatusCodes, when set, lists the only redirect statuses to follow; any
+	// other redirect is returned to the caller as it is, as if it were successful
+	PreserveMethodOnRedirect bool
+	FollowStatusCodes        []int
+
+	// Proxy, when set, picks the proxy each request is sent through, exactly as
+	// http.Transport.Proxy does, such that each client may use a proxy (and proxy
+	// credentials, as the URL's userinfo) of its own. It's plugged into a clone of
+	// the embedded client's transport, which must therefore be an *http.Transport
+	// (or nil, for http.DefaultTransport); calls otherwise fail with
+	// ErrProxyUnsupported.
+	//
+	// The clone is made the first time the client is used, and so later changes to
+	// Proxy, or to the transport, are ignored. Keeping it needs a client created
+	// with New (or friends); calls through any other fail with ErrNoClientState
+	Proxy func(req *http.Request) (*url.URL, error)
+
+	// MaxRedirects is the number of redirects followed before giving up on a request,
+	// which is then failed permanently. 0 leaves it to the embedded client, which,
+	// unless it has a CheckRedirect of its own, follows up to 10
+	MaxRedirects int
+
+	// PauseOnRedirectRetryAfter has redirects which carry a Retry-After header
+	// followed only once the delay is up (as adjusted by RetryAfterJitter,
+	// MinRetryAfter, and MaxRetryAfter), which suits auth proxies which both
+	// redirect and throttle. Waits give up should the request's context be done.
+	//
+	// HonorRedirectRetryAfter, where set, takes precedence for 307s and 308s
+	PauseOnRedirectRetryAfter bool
+
+	// MaxConcurrent caps the number of calls to DoWithContext which may be in flight
+	// at once across the whole client, with further calls waiting their turn (or
+	// for their context to be done). 0 means no cap.
+	//
+	// The cap is fixed by the first call made. It needs a client created with New
+	// (or friends), and calls through any other fail with ErrNoClientState
+	MaxConcurrent int
+
+	// Store, when set, remembers the Idempotency-Key header of every successful
+	// request. Later requests with an already successful key aren't sent at all;
+	// instead DoWithContext returns a stand-in `200 OK` response, with an empty body
+	// and an `Idempotent-Replayed: true` header, having made zero attempts.
+	//
+	// The original response isn't kept, so callers needing its body must hold on to
+	// it themselves
+	Store IdempotencyStore
+
+	// UserAgent, when set, is used as the User-Agent header of requests which don't
+	// already have one
+	UserAgent string
+
+	// RetryOnBodyContains lists strings which, when found in the body of an otherwise
+	// successful response, cause the request to be retried. This suits upstreams
+	// which say "please try again" in the body of a 200.
+	//
+	// Setting this forces every successful response body to be read into memory
+	// (the caller gets an in-memory copy), so it isn't suitable for large or
+	// streaming responses
+	RetryOnBodyContains []string
+
+	// RetryOnEmptyBody has successful responses with an empty body retried, for
+	// upstreams which answer with an empty 200 while they're still working out the
+	// real one. Responses which are empty by design, such as a 204 or the answer to
+	// a HEAD request, are left alone.
+	//
+	// Only the first byte of each body is read to check, and is put back before the
+	// response is returned, so the caller gets the whole body
+	RetryOnEmptyBody bool
+
+	// Clock tells the time for, and does the waiting of, retry schedules and the
+	// limits on them. nil means the wall clock, which is what you want outside of
+	// tests
+	Clock Clock
+
+	// WaitObserver, when set, is called with every wait before a retry, as worked
+	// out from the schedule, Retry-After, and so on. Alongside a fake Clock, this
+	// lets tests check a schedule without sleeping through it
+	WaitObserver func(d time.Duration)
+
+	// Cache, when set, keeps the most recent successful response to each GET request,
+	// keyed by URL, reading response bodies into memory to do so (the caller gets an
+	// in-memory copy). Responses are never served from the cache while calls are
+	// succeeding; it's there for StaleOnError to fall back on. The URL is the one
+	// the caller asked for, rather than that of any one attempt, which Endpoints or
+	// QueryParamOnRetry may have changed.
+	//
+	// A URL alone says nothing of who's asking, so requests carrying credentials
+	// (such as an Authorization or Cookie header) aren't cached by default, lest
+	// StaleOnError serve one caller's response to another. CacheKey changes that
+	Cache ResponseCache
+
+	// CacheKey, when set, returns the key under which Cache keeps the response to a
+	// request, in place of its URL, such as the URL and the user it's for. Requests
+	// for which it returns "" aren't cached. Whatever tells apart the responses of
+	// different callers must be part of the key
+	CacheKey func(req *http.Request) string
+
+	// StaleOnError has GET calls which fail return the response kept in Cache for
+	// the same URL (or CacheKey), where there is one, in place of the error. Stale responses carry
+	// a StaleHeader header, and StaleFromContext reports them.
+	//
+	// Calls which fail permanently, such as with a 4xx, still return their error,
+	// since they suggest something is wrong with the request rather than the server
+	StaleOnError bool
+
+	// AutoDecompress asks for compressed responses, sending an Accept-Encoding
+	// header (unless the request has one already) listing every encoding we can
+	// decompress, and decompresses the body of the response returned by the call.
+	// Responses with any other encoding are returned untouched.
+	//
+	// gzip and deflate are supported out of the box, and the decompress package
+	// adds br and zstd. Decoders adds others, keyed by content encoding, or
+	// replaces the built-in ones.
+	//
+	// Only the final response is decompressed, so body checks such as
+	// RetryOnBodyContains see compressed bodies
+	AutoDecompress bool
+	Decoders       map[string]Decoder
+
+	// JSONErrorCodePath and RetryableJSONCodes retry responses which carry an error
+	// code in a JSON body, whatever their status, for APIs which return things like
+	// `{"error": {"code": "RATE_LIMITED"}}` with a 200 or a 400.
+	//
+	// JSONErrorCodePath is a dotted path to the code within the body, such as
+	// `error.code`, and the response is retried when the code found there (be it a
+	// string or a number) is in RetryableJSONCodes. Bodies which aren't JSON, or
+	// which have nothing at the path, are left to the usual checks.
+	//
+	// As with RetryOnBodyContains, response bodies are read into memory, and the
+	// caller gets an in-memory copy
+	JSONErrorCodePath  string
+	RetryableJSONCodes []string
+
+	// BufferResponse has successful response bodies read in full before they're
+	// returned (the caller gets an in-memory copy), such that a read which fails
+	// part way through, as when a connection is reset mid-stream, is retried like
+	// any other failed attempt. A successful call then always has a complete body.
+	//
+	// The price is memory: every successful body is held in memory in its entirety,
+	// so this isn't suitable for large downloads or streams (see DoStream instead)
+	BufferResponse bool
+
+	// AsyncPoll, when set, has a successful `202 Accepted` response with a Location
+	// header followed up by polling that Location, with GET requests and the usual
+	// backoff, until it responds with anything other than a 202. The result of the
+	// polling is returned in place of the 202.
+	//
+	// Polls are subject to the same limits on attempts and time as any other call,
+	// and the call's metadata describes the polling, rather than the original request
+	AsyncPoll bool
+
+	// OnNotAcceptable, when set, is called the first time a call gets a 406 Not
+	// Acceptable, and may relax the request's Accept header before returning true
+	// to have it retried. Otherwise, 406s fail permanently, as any other 4xx
+	OnNotAcceptable func(req *http.Request) bool
+
+	// OnConflict, when set, has 409 Conflict responses retried (with the usual
+	// backoff), having first been given the chance to bring the request up to date,
+	// such as by re-reading the current version of a resource and adjusting an
+	// If-Match header. Returning an error fails the call with it. Otherwise, 409s
+	// fail permanently, as any other 4xx.
+	//
+	// Hooks which replace the body must replace GetBody too, since retries are sent
+	// with a fresh copy of the body from GetBody
+	OnConflict func(req *http.Request) error
+
+	// RetryPolicyWithHeaders, when set, is consulted for every response, save for
+	// 429s and (with HonorRedirectRetryAfter) throttling redirects, which keep their
+	// Retry-After handling. It's handy where the status alone isn't enough to go on,
+	// such as a 503 which is worth retrying, unless it carries `X-Maintenance: true`.
+	//
+	// Returning permanent fails the call, and returning retry retries it, whatever
+	// the status (permanent wins, should both be true). Returning neither leaves the
+	// response to the usual rules
+	RetryPolicyWithHeaders func(status int, headers http.Header) (retry, permanent bool)
+
+	// SuccessOnError, when set, is offered every transient error, and may have the
+	// call return successfully there and then by returning true, with neither a
+	// response nor an error. This suits best-effort calls, such as telemetry pushes,
+	// for which a context.DeadlineExceeded is good enough. The error is available
+	// from ErrorAsSuccessFromContext.
+	//
+	// Callers must be ready for DoWithContext to return a nil response, and a nil
+	// error, when this is set. The helpers built on it (DoAndDecode, DoStream, Warmup
+	// and WaitForHealthy) take such a call as a success with nothing to read
+	SuccessOnError func(err error) bool
+
+	// StopRetryIf, when set, is consulted for responses which would otherwise be
+	// retried, and may fail the call permanently by returning true, such as for a 5xx
+	// whose body says it's never going to work. This saves spending the whole retry
+	// budget on a lost cause.
+	//
+	// StopRetryIf may read the response body, so long as it leaves a body in its
+	// place for the caller, such as an in-memory copy
+	StopRetryIf func(resp *http.Response) bool
+
+	// SingleFlight coalesces concurrent calls for the same method and URL into a
+	// single call (retries and all), the result of which is shared between them.
+	// This saves a stampede of identical requests when, say, a cache expires.
+	// Only idempotent requests without a body are coalesced.
+	//
+	// Each caller receives its own copy of the response, with its own copy of the
+	// body, which is read into memory in full, and so should be kept small. Errors
+	// are shared too, including those from the context of whichever call went
+	// first, as are panics. Metadata is only recorded against the context of that
+	// first call.
+	//
+	// Headers play no part in the match, so callers with different credentials
+	// share a response made with the credentials of whichever went first. Clients
+	// shared between users should set SingleFlightKey to tell them apart, or leave
+	// SingleFlight off.
+	//
+	// As with MaxConcurrent, calls through clients not created with New (or
+	// friends) fail with ErrNoClientState
+	SingleFlight bool
+
+	// SingleFlightKey, when set, returns the key under which a request is coalesced
+	// by SingleFlight, in place of its method and URL. Requests with the same key
+	// share a call
+	SingleFlightKey func(req *http.Request) string
+
+	// RetryableStatusCodes lists client error statuses, which would otherwise fail
+	// permanently, to be retried like any other transient failure.
+	//
+	// 402 Payment Required is a likely candidate: some metered APIs return it for
+	// as long as a billing check takes, before going on to return a 200
+	RetryableStatusCodes []int
+
+	// CaptureErrorBody, when set, reads the start of the body of the final response
+	// of a failed call (be it a permanent 4xx, or the last of the retries), up to
+	// MaxErrorBodyBytes (4KiB where unset). The captured body is available via
+	// ErrorBodyFromContext, and the returned error is suffixed with the start of it.
+	//
+	// The response, and its body, are still returned in full
+	CaptureErrorBody  bool
+	MaxErrorBodyBytes int64
+
+	// PermanentStatusCodes lists statuses, which would otherwise be retried, to fail
+	// permanently instead, taking precedence over RetryableStatusCodes.
+	//
+	// This allows, say, a 500 from an application which genuinely errored to fail
+	// fast, while the 502, 503, and 504 (see GatewayStatusCodes) given by load
+	// balancers which can't reach a backend are still retried
+	PermanentStatusCodes []int
+
+	// SuccessStatusRange is the inclusive range of statuses which count as success,
+	// which defaults to {200, 299}. Clients which don't follow redirects may want to
+	// widen it to {200, 399}, so that redirects are returned rather than retried.
+	//
+	// 429s, throttling redirects, and RetryPolicyWithHeaders are all dealt with
+	// first, and so take precedence. Beyond that, statuses within the range succeed,
+	// even 4xx ones; those outside it are retried, save for 4xx ones, which fail
+	// permanently
+	SuccessStatusRange [2]int
+
+	// SuccessPredicate, when set, decides which responses are successful in place
+	// of SuccessStatusRange. Responses it rejects are retried as transient failures,
+	// 2xx or not, save for 4xx responses, which still fail permanently.
+	//
+	// This makes for a simple poller, such as for an API which responds `200 OK`
+	// while a job is in progress, and `201 Created` once it's done. It may be
+	// overridden for a single call with ContextWithSuccessPredicate
+	SuccessPredicate func(resp *http.Response) bool
+
+	// RetryableNetErrors, when set, lists the only errors (as matched by errors.Is)
+	// on which a request which failed without a response is retried; anything else
+	// fails permanently. DefaultRetryableNetErrors makes a good starting point.
+	// HTTP/2 GOAWAYs and refused streams, which the server never processed, are
+	// retried whether they're listed or not.
+	//
+	// By default, everything bar redirect loops and certificate problems is retried
+	RetryableNetErrors []error
+
+	// Signer, when set, is called before every attempt, retries included, so that
+	// requests signed with a timestamp (such as with AWS SigV4) are never sent with a
+	// stale signature. It may read the request body to sign it, so long as the
+	// request has a GetBody function (see NewRequest) to rewind it with.
+	//
+	// An error from Signer fails the call
+	Signer func(req *http.Request) error
+
+	// MaxRetriesHeader names a response header (such as X-Max-Retries) with which
+	// the server may lower the number of retries remaining to the call, counting
+	// from the response carrying it. It's only ever lowered, never raised, and
+	// headers which aren't a non-negative integer are ignored
+	MaxRetriesHeader string
+
+	// DeadlineHeader, when set, names a response header, such as X-Retry-Deadline,
+	// with which the server may say when retrying becomes pointless. Should the next
+	// attempt be due after the deadline, the call stops there, returning the last
+	// error. The deadline may be an HTTP-date or an rfc3339 timestamp
+	DeadlineHeader string
+
+	// NextEndpoint, when set, is called before every retry (but not the first
+	// attempt) to pick the URL the retry is sent to, with attempt counting from 2.
+	// This allows retries to be spread across a pool of endpoints, so that a single
+	// unhealthy host doesn't fail the call. Returning nil keeps the current URL.
+	//
+	// The caller's request is left untouched, and the Host header, where set on the
+	// request, is kept
+	NextEndpoint func(req *http.Request, attempt int) *url.URL
+
+	// Endpoints, when set, sends every attempt (the first included) to the scheme and
+	// host of an endpoint picked from the pool at random, weighted as per the pool,
+	// keeping the request's path and query. Random numbers come from Rand, where set.
+	// As with NextEndpoint, the caller's request and Host header are left untouched,
+	// and NextEndpoint, where also set, has the final say on retries
+	Endpoints *EndpointPool
+
+	// OnRecovery, when set, is called once for every call which succeeds having
+	// failed at least once beforehand, with the host it succeeded against and the
+	// attempt it succeeded on. It's a counterpart to retry events (see Subscribe),
+	// such as for resolving alerts raised by them
+	OnRecovery func(host string, afterAttempts int)
+
+	// EscalateAfter and OnEscalate allow for a struggling dependency to be noticed
+	// before calls to it start failing outright. Once a call has made EscalateAfter
+	// attempts without success, OnEscalate is called (the once per call) before the
+	// next attempt, which is numbered attempt
+	EscalateAfter int
+	OnEscalate    func(req *http.Request, attempt int)
+
+	// Metrics, when set, is told about every attempt, retry, and call made through
+	// the client
+	Metrics MetricsRecorder
+
+	// Trace enables the recording of every attempt made by a call, including its
+	// status, headers, duration, error, and the delay which followed it, available
+	// via TraceFromContext. This is heavier than the other metadata, but gives a
+	// single record of how a call went, which is handy for debugging failures
+	Trace bool
+
+	// QueryParamOnRetry, when set, is called before every attempt, with attempt
+	// counting from 1, for query parameters to set on that attempt, such as
+	// `attempt=N`. Parameters replace any of the same name, rather than being added
+	// alongside them, and the caller's request is left untouched
+	QueryParamOnRetry func(attempt int) url.Values
+
+	// MaxTotalRequests caps the number of requests the client may make over its
+	// whole lifetime, retries and hedged copies included. Once it's reached, calls
+	// fail with a RequestQuotaExceededError without anything being sent, and no
+	// more copies are hedged. 0 means no cap.
+	//
+	// As with MaxConcurrent, calls through clients not created with New (or
+	// friends) fail with ErrNoClientState, rather than going uncounted
+	MaxTotalRequests int64
+
+	state           *clientState
+	backOffProvider backOffProvider
 }
 
-// New returns an HttpClient with some retry logic attached
-func New() *HttpClient {
-	return &HttpClient{
+// New returns an HttpClient with some retry logic attached, and with opts applied
+// over the defaults
+func New(opts ...Option) *HttpClient {
+	c := &HttpClient{
 		MaxRetries:     9, // For a total of 10 calls, by default
 		MaxInterval:    time.Second * 30,
 		MaxElapsedTime: 0, // Never gonna give you up
 		Client:         http.DefaultClient,
+		state:          newClientState(),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// NewWithTransport returns an HttpClient with the same defaults as New, but which
+// sends its requests via rt rather than http.DefaultTransport.
+//
+// This is handy for pre-configured transports (proxies, TLS config, and so on), and
+// for tests which want to stub out the network
+func NewWithTransport(rt http.RoundTripper, opts ...Option) *HttpClient {
+	c := New(opts...)
+	c.Client = &http.Client{Transport: rt}
+
+	return c
+}
+
+// WrapTransport returns an HttpClient with the same defaults as New, layering
+// retries over base, for the common case of already having a configured transport.
+// It's NewWithTransport, without the options
+func WrapTransport(base http.RoundTripper) *HttpClient {
+	return NewWithTransport(base)
+}
+
+// forDurationAttempts and forDurationMultiplier shape the schedules built by
+// NewForDuration
+const (
+	forDurationAttempts   = 10
+	forDurationMultiplier = 1.5
+)
+
+// NewForDuration returns an HttpClient which keeps retrying for around total, and
+// no longer, with opts applied over the top.
+//
+// The schedule is chosen such that the waits between the first ten attempts add up
+// to roughly total, with MaxElapsedTime set to total to cut off any stragglers.
+//
+// A total of 0 or less leaves no time to retry in, so calls make a single attempt
+func NewForDuration(total time.Duration, opts ...Option) *HttpClient {
+	if total <= 0 {
+		return New(append([]Option{WithMaxAttempts(1)}, opts...)...)
+	}
+
+	// The waits form a geometric series, the sum of which is
+	// initial * (multiplier^n - 1) / (multiplier - 1)
+	sum := (math.Pow(forDurationMultiplier, forDurationAttempts-1) - 1) / (forDurationMultiplier - 1)
+
+	c := New()
+	c.MaxRetries = 0
+	c.MaxElapsedTime = total
+	c.Multiplier = forDurationMultiplier
+	c.InitialInterval = time.Duration(float64(total) / sum)
+	c.MaxInterval = total / 4
+
+	for _, opt := range opts {
+		opt(c)
 	}
+
+	return c
 }
 
 // DoWithContext wraps the http.Client.Do function, accepting an additional context
@@ -59,34 +660,194 @@ func New() *HttpClient {
 // returns a non-429 4xx error.
 //
 // Anything else is retried.
+//
+// Metadata is recorded against ctx where it was created by NewContext (or
+// ContextWithMetadata), or else against the request's own context. Failing both,
+// it's recorded against the context of the request handed to the transport, which
+// callers can get at with resp.Request.Context()
 func (h HttpClient) DoWithContext(ctx context.Context, req *http.Request) (*http.Response, error) {
-	// Create a backoff per request; they're not thread safe
-	bo := backoff.NewExponentialBackOff()
-	bo.MaxInterval = h.MaxInterval
+	if h.canCoalesce(req) {
+		return h.state.coalesce(ctx, h.singleFlightKey(req), func() (*http.Response, error) {
+			return h.do(ctx, req, nil)
+		})
+	}
+
+	return h.do(ctx, req, nil)
+}
+
+// DoFunc is DoWithContext for requests which must be built afresh for every attempt,
+// such as those which are signed with a timestamp or which stream their bodies,
+// calling build before each attempt rather than rewinding the one request.
+//
+// Client-wide settings (UserAgent, Signer, and so on) apply to every request
+// built, and metadata is recorded as per DoWithContext. An error from build fails
+// the call there and then.
+//
+// Calls made with DoFunc aren't coalesced by SingleFlight
+func (h HttpClient) DoFunc(ctx context.Context, build func() (*http.Request, error)) (*http.Response, error) {
+	req, err := build()
+	if err != nil {
+		return nil, err
+	}
+
+	return h.do(ctx, req, build)
+}
+
+// do is DoWithContext, minus any coalescing. Where rebuild is set, it's used in
+// place of req for each attempt after the first
+func (h HttpClient) do(ctx context.Context, req *http.Request, rebuild func() (*http.Request, error)) (*http.Response, error) {
+	if h.state == nil && (h.MaxConcurrent > 0 || h.MaxTotalRequests > 0 || h.SingleFlight || h.Proxy != nil) {
+		return nil, ErrNoClientState
+	}
+
+	release, err := h.state.acquire(ctx, h.MaxConcurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	// Released early should we go on to poll, which takes a slot of its own
+	release = sync.OnceFunc(release)
+	defer release()
+
+	if fn, ok := getSuccessPredicate(ctx); ok {
+		h.SuccessPredicate = fn
+	}
+
+	bo := h.backOffs().newBackOff(h)
 
 	metadata, ok := getRequestMetadata(ctx)
 	if !ok {
-		// If we get a context not created by HttpClient.NewContext() then that's
-		// cool, we just wont be able to do anything with it
+		metadata, ok = getRequestMetadata(req.Context())
+	}
+
+	attached := ok
+	if !attached {
 		metadata = new(requestMetadata)
 	}
 
+	// Metadata may be reused across calls, so none of the last call's may linger
 	metadata.requests = 0
+	metadata.successfulAttempt = 0
+	metadata.successfulDuration = 0
+	metadata.terminationReason = ReasonSuccess
+	metadata.connTiming = ConnTiming{}
+	metadata.capturedHeaders = nil
+	metadata.errorBody = nil
+	metadata.backoffStrategy = h.JitterStrategy.String()
+	metadata.trace = nil
+	metadata.hitRateLimit = false
+	metadata.stale = false
+	metadata.errorAsSuccess = nil
+	metadata.retryAfterWaited = 0
+	metadata.bytesSent.Store(0)
+	metadata.bytesReceived.Store(0)
 
-	operation := func() (*http.Response, error) {
-		metadata.requests++
+	// prepare readies a request for its attempts, be it the one we were given or
+	// one built by rebuild
+	prepare := func(req *http.Request) *http.Request {
+		if !attached {
+			// If we get a context not created by NewContext() then that's cool; we
+			// hang the metadata off the request's context instead, where it can be
+			// found via the response's Request
+			req = req.WithContext(context.WithValue(req.Context(), httpRequestMetadataContextKey{}, metadata))
+		}
 
-		// If we've used up all of our request attempts, return so we can
-		// log accordingly.
-		//
-		// Note that we add `1` to the number of MaxRetries since the first
-		// attempt isn't a retry, it's a _try_
-		//
-		// MaxRetries may be 0 to override the retry logic and instead base it on MaxElapsedTime.
-		// In which case this won't apply.
-		if h.MaxRetries > 0 && metadata.requests >= h.MaxRetries+1 {
-			return nil, &backoff.PermanentError{
-				Err: MaxAttemptsReachedError{c: h.MaxRetries + 1},
+		// Set once, up front, so that it persists across attempts; on a copy of the
+		// headers, so that the caller's request is left as it was
+		if h.UserAgent != "" && req.Header.Get("User-Agent") == "" {
+			req = req.WithContext(req.Context())
+			req.Header = req.Header.Clone()
+
+			if req.Header == nil {
+				req.Header = make(http.Header)
+			}
+
+			req.Header.Set("User-Agent", h.UserAgent)
+		}
+
+		// On a copy of the headers, since the caller's request may well be reused
+		// by a client without AutoDecompress, which would then get a compressed body
+		if h.AutoDecompress && req.Header.Get("Accept-Encoding") == "" {
+			req = req.WithContext(req.Context())
+			req.Header = req.Header.Clone()
+
+			if req.Header == nil {
+				req.Header = make(http.Header)
+			}
+
+			req.Header.Set("Accept-Encoding", h.acceptEncoding())
+		}
+
+		// Attempts may be altered; do so on a copy, so that the caller's request is
+		// left as it was
+		if h.NextEndpoint != nil || h.Endpoints != nil || h.QueryParamOnRetry != nil || h.DisableKeepAlives {
+			req = req.WithContext(req.Context())
+		}
+
+		// Asking for the connection to be closed after each request has the same
+		// effect as disabling keep-alives on the transport, without meddling with a
+		// transport which may well be shared (such as http.DefaultTransport)
+		if h.DisableKeepAlives {
+			req.Close = true
+		}
+
+		return req
+	}
+
+	// Attempts may go to other hosts, or carry extra query parameters; the cache
+	// is keyed on what the caller asked for
+	cacheReq := req
+
+	req = prepare(req)
+
+	idempotencyKey := req.Header.Get(IdempotencyKeyHeader)
+	if h.Store != nil && idempotencyKey != "" && h.Store.Seen(idempotencyKey) {
+		metadata.terminationReason = ReasonSuccess
+
+		return replayedResponse(req), nil
+	}
+
+	var renegotiated bool
+
+	attempt := func() (*http.Response, error) {
+		err := h.state.waitUnpaused(ctx)
+		if err != nil {
+			return nil, backoff.Permanent(err)
+		}
+
+		if !h.state.takeRequest(h.MaxTotalRequests) {
+			return nil, backoff.Permanent(RequestQuotaExceededError{Limit: h.MaxTotalRequests})
+		}
+
+		if rebuild != nil && metadata.requests > 1 {
+			r, err := rebuild()
+			if err != nil {
+				return nil, backoff.Permanent(err)
+			}
+
+			req = prepare(r)
+		}
+
+		if h.Endpoints != nil {
+			if u := h.Endpoints.pick(h.randFloat64()); u != nil {
+				req.URL = withEndpoint(req.URL, u)
+			}
+		}
+
+		if h.NextEndpoint != nil && metadata.requests > 1 {
+			if u := h.NextEndpoint(req, metadata.requests); u != nil {
+				req.URL = u
+			}
+		}
+
+		if h.QueryParamOnRetry != nil {
+			req.URL = withQueryParams(req.URL, h.QueryParamOnRetry(metadata.requests))
+		}
+
+		if h.Limiter != nil {
+			err := h.Limiter.Wait(ctx, req.URL.Host)
+			if err != nil {
+				return nil, backoff.Permanent(err)
 			}
 		}
 
@@ -102,14 +863,96 @@ func (h HttpClient) DoWithContext(ctx context.Context, req *http.Request) (*http
 			req.Body = body
 		}
 
+		// Signatures often include a timestamp, and so must be made afresh for every
+		// attempt. Signers may read the body to sign it, so it's rewound (again)
+		// afterwards
+		if h.Signer != nil {
+			err := h.Signer(req)
+			if err != nil {
+				return nil, backoff.Permanent(err)
+			}
+
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, backoff.Permanent(err)
+				}
+				req.Body = body
+			}
+		}
+
+		var (
+			attemptReq = req
+			tracer     *connTracer
+		)
+
+		if h.TraceConnections {
+			tracer = new(connTracer)
+			attemptReq = tracer.trace(req)
+		}
+
+		attemptReq = countRequestBody(attemptReq, &metadata.bytesSent)
+
+		var cancel context.CancelFunc
+		if timeout := h.attemptTimeout(metadata.requests); timeout > 0 {
+			var actx context.Context
+
+			actx, cancel = context.WithTimeout(attemptReq.Context(), timeout)
+			attemptReq = attemptReq.WithContext(actx)
+		}
+
+		var phased *phasedTimeout
+		if h.UploadTimeout > 0 || h.ResponseTimeout > 0 {
+			attemptReq, phased = h.withPhasedTimeout(attemptReq)
+		}
+
 		start := time.Now()
-		resp, err := h.Do(req)
+		resp, err := h.send(attemptReq)
 		requestDuration := time.Since(start)
 
+		if phased != nil {
+			resp, err = phased.responded(attemptReq.Context(), resp, err)
+		}
+
+		// The timeout covers reading the body, too, so may only be cancelled once
+		// the body is closed
+		switch {
+		case cancel == nil:
+		case resp != nil:
+			resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+		default:
+			cancel()
+		}
+
+		if len(h.CaptureHeaders) > 0 {
+			metadata.capturedHeaders = captureHeaders(resp, h.CaptureHeaders)
+		}
+
 		if err != nil {
 			switch {
-			case redirectErrorString.MatchString(err.Error()),
-				untrustedCertErrorString.MatchString(err.Error()):
+			// Requests an HTTP/2 server provably never processed (GOAWAY and
+			// REFUSED_STREAM) are always worth another go, allowlist or not
+			case isUnprocessedError(err):
+				return nil, err
+
+			// Otherwise an allowlist, where given, has the final say
+			case len(h.RetryableNetErrors) > 0:
+				if isRetryableNetError(err, h.RetryableNetErrors) {
+					return nil, err
+				}
+
+				return nil, backoff.Permanent(err)
+
+			// A connection dropped or garbled mid-handshake is worth another go,
+			// even though it happened during TLS
+			case isTransientHandshakeError(err):
+				return nil, err
+
+			case errors.Is(err, ErrProxyUnsupported),
+				errors.Is(err, ErrBodyNotRewindable),
+				redirectErrorString.MatchString(err.Error()),
+				untrustedCertErrorString.MatchString(err.Error()),
+				isCertificateError(err):
 				return nil, backoff.Permanent(err)
 			}
 
@@ -121,36 +964,644 @@ func (h HttpClient) DoWithContext(ctx context.Context, req *http.Request) (*http
 		// If we are being rate limited, return a RetryAfter to specify how long to wait.
 		// This will also reset the backoff policy.
 		if resp.StatusCode == 429 {
+			metadata.hitRateLimit = true
+
 			ra := resp.Header.Get("Retry-After")
+			if ra == "" && h.ExponentialOn429WithoutHeader {
+				return resp, errors.New(resp.Status)
+			}
+
 			if ra == "" {
-				return nil, backoff.RetryAfter(default429RetrySeconds)
+				return resp, h.retryAfter(time.Duration(default429RetrySeconds) * time.Second)
+			}
+
+			d, ok := ParseRetryAfter(ra, h.clock().Now())
+			if !ok {
+				return resp, fmt.Errorf("%s: invalid Retry-After %q", resp.Status, ra)
 			}
 
-			seconds, err := strconv.ParseInt(ra, 10, 64)
+			return resp, h.retryAfter(d)
+		}
+
+		// A temporary redirect with a Retry-After means "come back later", rather than
+		// "go elsewhere"; we only get to see these if we've been told to intercept them
+		if h.HonorRedirectRetryAfter && isThrottlingRedirect(resp) {
+			ra := resp.Header.Get("Retry-After")
+
+			d, ok := ParseRetryAfter(ra, h.clock().Now())
+			if !ok {
+				return resp, fmt.Errorf("%s: invalid Retry-After %q", resp.Status, ra)
+			}
+
+			return resp, h.retryAfter(d)
+		}
+
+		// A picky server may yet accept a request with a relaxed Accept header; it
+		// gets the one chance
+		if resp.StatusCode == http.StatusNotAcceptable && h.OnNotAcceptable != nil && !renegotiated {
+			renegotiated = true
+
+			if h.OnNotAcceptable(req) {
+				return resp, errors.New(resp.Status)
+			}
+		}
+
+		// An optimistic concurrency check failed; there's a chance the request can be
+		// brought up to date, and retried
+		if resp.StatusCode == http.StatusConflict && h.OnConflict != nil {
+			err := h.OnConflict(req)
 			if err != nil {
-				return nil, err
+				return resp, backoff.Permanent(fmt.Errorf("%s: %w", resp.Status, err))
+			}
+
+			return resp, errors.New(resp.Status)
+		}
+
+		if h.RetryPolicyWithHeaders != nil {
+			retry, permanent := h.RetryPolicyWithHeaders(resp.StatusCode, resp.Header)
+
+			switch {
+			case permanent:
+				return resp, backoff.Permanent(errors.New(resp.Status))
+			case retry:
+				return resp, h.transientStatusError(resp)
 			}
+		}
+
+		if h.JSONErrorCodePath != "" && len(h.RetryableJSONCodes) > 0 {
+			err = h.checkJSONErrorCode(resp)
+			if err != nil {
+				return resp, err
+			}
+		}
+
+		// Redirects we chose not to follow are the caller's to deal with
+		success := h.isSuccess(resp) || h.isUnfollowedRedirect(resp)
 
-			return nil, backoff.RetryAfter(int(seconds))
+		if !success && slices.Contains(h.PermanentStatusCodes, resp.StatusCode) {
+			return resp, backoff.Permanent(errors.New(resp.Status))
+		}
+
+		if !success && slices.Contains(h.RetryableStatusCodes, resp.StatusCode) {
+			return resp, h.transientStatusError(resp)
 		}
 
 		// Treat any non 429 client error as a permanent error
-		if resp.StatusCode/100 == 4 {
+		if !success && resp.StatusCode/100 == 4 {
 			return resp, backoff.Permanent(errors.New(resp.Status))
 		}
 
-		// Treat any other non-2xx status as a transient error (the DefaultClient from
-		// `net/http` already handles 3xx redirects, so we're in no danger of breaking
-		// those here)
-		if resp.StatusCode/100 != 2 {
-			return resp, errors.New(resp.Status)
+		// Treat anything else unsuccessful as a transient error
+		if !success {
+			return resp, h.transientStatusError(resp)
+		}
+
+		if h.GRPCStatusRetry != nil {
+			err = h.checkGRPCStatus(resp)
+			if err != nil {
+				return resp, err
+			}
+		}
+
+		if len(h.RetryOnBodyContains) > 0 {
+			err = h.checkBodyContains(resp)
+			if err != nil {
+				return resp, err
+			}
+		}
+
+		if h.RetryOnEmptyBody {
+			err = checkEmptyBody(resp)
+			if err != nil {
+				return resp, err
+			}
+		}
+
+		// A body which can't be read in full is as good as a failed attempt; the
+		// response is no use to anyone, so isn't returned
+		if h.BufferResponse {
+			_, err = bufferBody(resp)
+			if err != nil {
+				return nil, fmt.Errorf("%s: reading response body: %w", resp.Status, err)
+			}
 		}
 
 		// If we get this far, the operation succeeded; update the duration, and return
 		metadata.successfulDuration = requestDuration
 
+		if tracer != nil {
+			metadata.connTiming = tracer.result()
+		}
+
+		resp.Body = countingReadCloser{ReadCloser: resp.Body, n: &metadata.bytesReceived}
+
+		if h.VerifyContentLength && resp.ContentLength > 0 {
+			resp.Body = &lengthVerifyingReadCloser{ReadCloser: resp.Body, expect: resp.ContentLength}
+		}
+
 		return resp, nil
 	}
 
-	return backoff.Retry(ctx, operation, backoff.WithBackOff(bo), backoff.WithMaxElapsedTime(h.MaxElapsedTime))
+	maxAttempts := h.maxAttempts(ctx)
+
+	operation := func() (*http.Response, error) {
+		metadata.requests++
+
+		// Fires the once, as we're about to go beyond EscalateAfter
+		if h.OnEscalate != nil && h.EscalateAfter > 0 && metadata.requests == h.EscalateAfter+1 {
+			h.OnEscalate(req, metadata.requests)
+		}
+
+		start := time.Now()
+
+		resp, err := attempt()
+		if err == nil {
+			metadata.successfulAttempt = metadata.requests
+		}
+
+		if h.Trace {
+			metadata.trace = append(metadata.trace, newAttemptRecord(metadata.requests, req, resp, err, time.Since(start)))
+		}
+
+		if h.Metrics != nil {
+			var status int
+			if resp != nil {
+				status = resp.StatusCode
+			}
+
+			h.Metrics.RecordAttempt(ctx, req.URL.Host, status, time.Since(start), err)
+		}
+
+		// Some calls would rather take a transient failure as good enough than
+		// keep at it
+		if err != nil && !isPermanent(err) && h.SuccessOnError != nil && h.SuccessOnError(err) {
+			discard(resp)
+			metadata.errorAsSuccess = err
+
+			return nil, nil
+		}
+
+		if err != nil && !isPermanent(err) && resp != nil && h.StopRetryIf != nil && h.StopRetryIf(resp) {
+			return resp, backoff.Permanent(err)
+		}
+
+		// Non-idempotent requests may need the server's blessing to be retried, unless
+		// the server never got as far as processing them
+		if err != nil && !isPermanent(err) && !isUnprocessedError(err) && !h.safeToRetry(req, resp) {
+			return resp, backoff.Permanent(err)
+		}
+
+		// The server may cut short, but never extend, the retries we have left
+		if err != nil && !isPermanent(err) && resp != nil && h.MaxRetriesHeader != "" {
+			if n, perr := strconv.Atoi(resp.Header.Get(h.MaxRetriesHeader)); perr == nil && n >= 0 {
+				if maxAttempts == 0 || metadata.requests+n < maxAttempts {
+					maxAttempts = metadata.requests + n
+				}
+			}
+		}
+
+		// If that was our last attempt, return so we can log accordingly.
+		//
+		// maxAttempts may be 0 to override the retry logic and instead base it on
+		// MaxElapsedTime, in which case this won't apply.
+		if err != nil && !isPermanent(err) && maxAttempts > 0 && metadata.requests >= maxAttempts {
+			return resp, backoff.Permanent(MaxAttemptsReachedError{c: metadata.requests})
+		}
+
+		// A server-set deadline is picked up by retry, which knows when the next
+		// attempt would be
+		if err != nil && !isPermanent(err) && resp != nil && h.DeadlineHeader != "" {
+			if deadline, ok := parseDeadline(resp.Header.Get(h.DeadlineHeader)); ok {
+				err = &serverDeadlineError{err: err, deadline: deadline}
+			}
+		}
+
+		return resp, err
+	}
+
+	notify := func(resp *http.Response, err error, next time.Duration, fromServer bool) {
+		if fromServer {
+			metadata.retryAfterWaited = next
+		}
+
+		if n := len(metadata.trace); n > 0 {
+			metadata.trace[n-1].Delay = next
+		}
+
+		op, _ := OperationFromContext(ctx)
+
+		ev := RetryEvent{
+			Host:      req.URL.Host,
+			Attempt:   metadata.requests,
+			URL:       attemptURL(req, resp),
+			Operation: op,
+			Delay:     next,
+			Err:       err,
+		}
+
+		if resp != nil {
+			ev.Status = resp.StatusCode
+		}
+
+		h.state.publish(ev)
+
+		if h.Metrics != nil {
+			h.Metrics.RecordRetry(ctx, req.URL.Host, metadata.requests, next)
+		}
+	}
+
+	// A deadline may be set on either context; whichever is done first ends the
+	// call, with its error
+	callCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	stop := context.AfterFunc(req.Context(), func() {
+		cancel(context.Cause(req.Context()))
+	})
+	defer stop()
+
+	callStart := time.Now()
+
+	resp, reason, err := h.retry(callCtx, bo, operation, notify)
+	metadata.terminationReason = reason
+
+	if h.Metrics != nil {
+		h.Metrics.RecordCall(ctx, req.URL.Host, metadata.requests, time.Since(callStart), reason)
+	}
+
+	// Running out of time is a transient failure too, albeit one which only turns
+	// up between attempts
+	if reason == ReasonContextCancelled && h.SuccessOnError != nil && h.SuccessOnError(err) {
+		discard(resp)
+		metadata.errorAsSuccess = err
+		metadata.terminationReason = ReasonSuccess
+	}
+
+	if metadata.errorAsSuccess != nil {
+		return nil, nil
+	}
+
+	if resp != nil && h.AutoDecompress {
+		derr := h.decompress(resp)
+		if derr != nil && err == nil {
+			err = derr
+		}
+	}
+
+	if err == nil && h.Cache != nil && cacheable(cacheReq) {
+		err = h.cacheResponse(cacheReq, resp)
+	}
+
+	if err != nil && resp != nil && h.CaptureErrorBody {
+		metadata.errorBody, err = h.captureErrorBody(resp, err)
+	}
+
+	if err == nil && h.Store != nil && idempotencyKey != "" {
+		h.Store.Mark(idempotencyKey)
+	}
+
+	if err == nil {
+		releaseBody(req)
+	}
+
+	// Better late than never; but not for requests which were never going to work
+	if err != nil && h.StaleOnError && h.Cache != nil && cacheable(cacheReq) && reason != ReasonPermanent {
+		if stale, ok := h.staleResponse(cacheReq); ok {
+			discard(resp)
+			metadata.stale = true
+
+			return stale, nil
+		}
+	}
+
+	// Only once nothing above has turned the call into a failure after all
+	if err == nil && h.OnRecovery != nil && metadata.successfulAttempt > 1 {
+		h.OnRecovery(req.URL.Host, metadata.successfulAttempt)
+	}
+
+	if err == nil && h.AsyncPoll {
+		release()
+
+		return h.pollAsync(ctx, req, resp)
+	}
+
+	return resp, err
+}
+
+// maxAttempts returns the total number of attempts a single call may make, where
+// 0 means there's no limit
+func (h HttpClient) maxAttempts(ctx context.Context) int {
+	if n, ok := getMaxRetries(ctx); ok {
+		h.MaxAttempts, h.MaxRetries = 0, n
+	}
+
+	switch {
+	case h.MaxAttempts > 0:
+		return h.MaxAttempts
+
+	// Note that we add `1` to the number of MaxRetries since the first attempt
+	// isn't a retry, it's a _try_
+	case h.MaxRetries > 0:
+		return h.MaxRetries + 1
+	}
+
+	return 0
+}
+
+// isPermanent returns true if err has been marked as not worth retrying
+func isPermanent(err error) bool {
+	var pe *backoff.PermanentError
+
+	return errors.As(err, &pe)
+}
+
+// safeToRetry returns false for non-idempotent requests where SafeToRetryHeader
+// is set, but resp hasn't given its blessing to a retry
+func (h HttpClient) safeToRetry(req *http.Request, resp *http.Response) bool {
+	if h.SafeToRetryHeader == "" || isIdempotent(req.Method) {
+		return true
+	}
+
+	if resp == nil {
+		return false
+	}
+
+	ok, _ := strconv.ParseBool(resp.Header.Get(h.SafeToRetryHeader))
+
+	return ok
+}
+
+// attemptTimeout returns the timeout for the given attempt, counting from 1, grown
+// by PerAttemptTimeoutGrowth for each attempt before it. 0 means there's no timeout
+func (h HttpClient) attemptTimeout(attempt int) time.Duration {
+	if h.PerAttemptTimeout <= 0 {
+		return 0
+	}
+
+	if h.PerAttemptTimeoutGrowth <= 1 {
+		return h.PerAttemptTimeout
+	}
+
+	return time.Duration(float64(h.PerAttemptTimeout) * math.Pow(h.PerAttemptTimeoutGrowth, float64(attempt-1)))
+}
+
+// withQueryParams returns a copy of u with params set on its query
+func withQueryParams(u *url.URL, params url.Values) *url.URL {
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+
+	c := *u
+	c.RawQuery = q.Encode()
+
+	return &c
+}
+
+// captureHeaders returns the subset of resp's headers listed in names, or nil
+// where there's no response to capture from
+func captureHeaders(resp *http.Response, names []string) http.Header {
+	if resp == nil {
+		return nil
+	}
+
+	captured := make(http.Header)
+
+	for _, name := range names {
+		if v := resp.Header.Values(name); len(v) > 0 {
+			captured[http.CanonicalHeaderKey(name)] = slices.Clone(v)
+		}
+	}
+
+	return captured
+}
+
+// send makes a single attempt at req, hedging it if configured to do so
+func (h HttpClient) send(req *http.Request) (*http.Response, error) {
+	if h.canHedge(req) {
+		return h.hedge(req)
+	}
+
+	return h.httpClient().Do(req)
+}
+
+// httpClient returns the *http.Client to send requests with which, where we need
+// to meddle with redirects or proxies, is a copy of the embedded client
+func (h HttpClient) httpClient() *http.Client {
+	client := h.Client
+
+	if h.Proxy != nil {
+		c := *client
+		c.Transport = h.state.proxied(c.Transport, h.Proxy)
+		client = &c
+	}
+
+	if !h.HonorRedirectRetryAfter && h.MaxRedirects <= 0 && !h.PauseOnRedirectRetryAfter &&
+		!h.PreserveMethodOnRedirect && h.FollowStatusCodes == nil {
+		return client
+	}
+
+	c := *client
+	next := c.CheckRedirect
+
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if h.HonorRedirectRetryAfter && isThrottlingRedirect(req.Response) {
+			return http.ErrUseLastResponse
+		}
+
+		if h.isUnfollowedRedirect(req.Response) {
+			return http.ErrUseLastResponse
+		}
+
+		if h.MaxRedirects > 0 && len(via) > h.MaxRedirects {
+			return fmt.Errorf("stopped after %d redirects", h.MaxRedirects)
+		}
+
+		if h.PauseOnRedirectRetryAfter && req.Response != nil {
+			d, ok := ParseRetryAfter(req.Response.Header.Get("Retry-After"), h.clock().Now())
+			if ok {
+				err := h.backOffs().wait(req.Context(), h.retryAfterDelay(d))
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if h.PreserveMethodOnRedirect {
+			err := preserveMethod(req, via)
+			if err != nil {
+				return err
+			}
+		}
+
+		if next != nil {
+			return next(req, via)
+		}
+
+		if h.MaxRedirects > 0 {
+			return nil
+		}
+
+		// As per the default policy in net/http
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+
+		return nil
+	}
+
+	return &c
+}
+
+// isUnfollowedRedirect returns true for redirects which FollowStatusCodes says
+// aren't to be followed
+func (h HttpClient) isUnfollowedRedirect(resp *http.Response) bool {
+	if h.FollowStatusCodes == nil || resp == nil || resp.StatusCode/100 != 3 {
+		return false
+	}
+
+	return !slices.Contains(h.FollowStatusCodes, resp.StatusCode)
+}
+
+// preserveMethod undoes net/http's switch to GET when following a 301 or 302,
+// restoring the method and body of the request which was redirected. 303s mean
+// "GET this instead", and so are left alone
+func preserveMethod(req *http.Request, via []*http.Request) error {
+	prev := via[len(via)-1]
+
+	if req.Response == nil || req.Response.StatusCode == http.StatusSeeOther {
+		return nil
+	}
+
+	req.Method = prev.Method
+
+	// Once net/http has dropped a body, it stays dropped for every hop after
+	if prev.Body == nil || prev.Body == http.NoBody || (req.Body != nil && req.Body != http.NoBody) {
+		return nil
+	}
+
+	if prev.GetBody == nil {
+		return fmt.Errorf("can't follow %s redirect with %s: %w", req.Response.Status, prev.Method, ErrBodyNotRewindable)
+	}
+
+	body, err := prev.GetBody()
+	if err != nil {
+		return err
+	}
+
+	req.Body = body
+	req.GetBody = prev.GetBody
+	req.ContentLength = prev.ContentLength
+
+	if ct := prev.Header.Get("Content-Type"); ct != "" && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", ct)
+	}
+
+	return nil
+}
+
+// isThrottlingRedirect returns true for 307 and 308 responses which also carry
+// a Retry-After header
+func isThrottlingRedirect(resp *http.Response) bool {
+	if resp == nil || resp.Header.Get("Retry-After") == "" {
+		return false
+	}
+
+	return resp.StatusCode == http.StatusTemporaryRedirect || resp.StatusCode == http.StatusPermanentRedirect
+}
+
+// captureErrorBody reads the start of resp's body, returning it alongside err
+// with a snippet of it attached
+func (h HttpClient) captureErrorBody(resp *http.Response, err error) ([]byte, error) {
+	n := h.MaxErrorBodyBytes
+	if n <= 0 {
+		n = defaultMaxErrorBodyBytes
+	}
+
+	body, _ := peekBody(resp, n)
+	if len(body) == 0 {
+		return body, err
+	}
+
+	snippet := string(body)
+	if len(snippet) > errorBodySnippetLength {
+		// Don't leave half a character dangling
+		snippet = strings.ToValidUTF8(snippet[:errorBodySnippetLength], "") + "..."
+	}
+
+	return body, fmt.Errorf("%w: %s", err, snippet)
+}
+
+// transientStatusError returns the error for a response which is to be retried.
+//
+// A 503 with a Retry-After waits for whichever is the longer of the Retry-After
+// (jittered and bounded as per retryAfterDelay) and the next interval of the
+// schedule, which carries on growing as normal. Without one, or with one we
+// can't parse, it simply follows the schedule
+func (h HttpClient) transientStatusError(resp *http.Response) error {
+	err := errors.New(resp.Status)
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		return err
+	}
+
+	d, ok := ParseRetryAfter(resp.Header.Get("Retry-After"), h.clock().Now())
+	if !ok {
+		return err
+	}
+
+	return &minimumDelayError{err: err, delay: h.retryAfterDelay(d)}
+}
+
+// isSuccess returns true if resp should be returned to the caller as a success,
+// as judged by SuccessPredicate where set.
+//
+// Otherwise, any status within SuccessStatusRange, which defaults to 2xx, is a
+// success (the DefaultClient from `net/http` already handles 3xx redirects, so
+// we're in no danger of breaking those here).
+//
+// 1xx responses are usually swallowed by net/http, but custom transports and
+// `Expect: 100-continue` flows can let them through. They're informational,
+// rather than failures, so are passed through to the caller untouched
+func (h HttpClient) isSuccess(resp *http.Response) bool {
+	if h.SuccessPredicate != nil {
+		return h.SuccessPredicate(resp)
+	}
+
+	if resp.StatusCode/100 == 1 {
+		return true
+	}
+
+	lo, hi := http.StatusOK, 299
+	if h.SuccessStatusRange != [2]int{} {
+		lo, hi = h.SuccessStatusRange[0], h.SuccessStatusRange[1]
+	}
+
+	return resp.StatusCode >= lo && resp.StatusCode <= hi
+}
+
+// checkGRPCStatus returns an error when resp carries a non-OK grpc-status header,
+// wrapped as permanent where GRPCStatusRetry says not to bother retrying
+func (h HttpClient) checkGRPCStatus(resp *http.Response) error {
+	gs := resp.Header.Get("Grpc-Status")
+	if gs == "" {
+		return nil
+	}
+
+	code, err := strconv.Atoi(gs)
+	if err != nil {
+		return backoff.Permanent(fmt.Errorf("invalid grpc-status %q: %w", gs, err))
+	}
+
+	// 0 is OK; everything else is some flavour of failure
+	if code == 0 {
+		return nil
+	}
+
+	err = GRPCStatusError{Code: code, Message: resp.Header.Get("Grpc-Message")}
+	if h.GRPCStatusRetry(code) {
+		return err
+	}
+
+	return backoff.Permanent(err)
 }
@@ -2,14 +2,31 @@ package retryable_test
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
+	"log"
+	"math"
+	mathrand "math/rand/v2"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/botsandus/retryable"
+	"github.com/botsandus/retryable/faulttransport"
 )
 
 func TestNew(t *testing.T) {
@@ -19,6 +36,29 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestWrapTransport(t *testing.T) {
+	ft := faulttransport.New(faulttransport.Status(http.StatusBadGateway), faulttransport.Status(http.StatusOK))
+
+	c := retryable.WrapTransport(ft)
+	c.InitialInterval = time.Millisecond
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := c.DoWithContext(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	if n := ft.Requests(); n != 2 {
+		t.Errorf("expected both attempts to go via the transport, received %d", n)
+	}
+}
+
 func TestHttpClient_DoWithContext(t *testing.T) {
 	for _, test := range []struct {
 		name           string
@@ -46,8 +86,7 @@ func TestHttpClient_DoWithContext(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			c := retryable.New()
-			c.MaxInterval = time.Millisecond
+			c := retryable.New(retryable.WithInstantBackoff())
 			c.MaxRetries = 1
 
 			ctx := retryable.NewContext()
@@ -158,6 +197,57 @@ func TestHttpClient_DoWithContext_UseMaxElapsedTime(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := retryable.NewTestClock(start)
+
+	c := retryable.New(retryable.WithTestClock(clock))
+	c.MaxRetries = 0                           // Set MaxRetries to 0
+	c.MaxElapsedTime = 1 * time.Second         // Allow 1 second for retries
+	c.InitialInterval = 100 * time.Millisecond // Short intervals
+	c.MaxInterval = 100 * time.Millisecond
+	c.JitterStrategy = retryable.NoJitter // Of exactly 100ms, for a predictable end
+
+	ctx := retryable.NewContext()
+
+	_, err = c.DoWithContext(ctx, req)
+
+	// Should fail due to MaxElapsedTime being exceeded
+	if err == nil {
+		t.Error("expected request to fail due to MaxElapsedTime exceeded")
+	}
+
+	reason, _ := retryable.TerminationReasonFromContext(ctx)
+	if reason != retryable.ReasonMaxElapsed {
+		t.Errorf("expected %s, received %s", retryable.ReasonMaxElapsed, reason)
+	}
+
+	// Another 100ms wait would have overrun, so the call stops at exactly 1s, having
+	// made an attempt at the start of each of the ten waits, and one at the end
+	if elapsed := clock.Now().Sub(start); elapsed != time.Second {
+		t.Errorf("expected simulated elapsed time of 1s, got %v", elapsed)
+	}
+
+	attempts, ok := retryable.NumberOfAttemptsFromContext(ctx)
+	if !ok {
+		t.Fatal("expected attempts in the context")
+	}
+
+	if attempts != 11 {
+		t.Errorf("expected 11 attempts with MaxRetries=0 and MaxElapsedTime, got %d", attempts)
+	}
+}
+
+func TestHttpClient_DoWithContext_UseMaxElapsedTime_RealTime(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	c := retryable.New()
 	c.MaxRetries = 0                       // Set MaxRetries to 0
 	c.MaxElapsedTime = 1 * time.Second     // Allow 1 second for retries
@@ -246,3 +336,5324 @@ func TestHttpClient_DoWithContext_WithHomegrownRequest(t *testing.T) {
 		t.Errorf("expected a payload of %d bytes, received %d bytes", len(payload), size)
 	}
 }
+
+func TestHttpClient_DoWithContext_GRPCStatusRetry(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		grpcStatus     string
+		expectAttempts int
+		expectError    bool
+	}{
+		{"OK succeeds", "0", 1, false},
+		{"Missing status succeeds", "", 1, false},
+		{"UNAVAILABLE is retried", "14", 2, true},
+		{"INVALID_ARGUMENT fails early", "3", 1, true},
+		{"Garbage fails early", "lol", 1, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if test.grpcStatus != "" {
+					w.Header().Set("Grpc-Status", test.grpcStatus)
+				}
+
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodPost, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.New(retryable.WithInstantBackoff())
+			c.MaxRetries = 1
+			c.GRPCStatusRetry = func(grpcStatus int) bool {
+				return grpcStatus == 14
+			}
+
+			ctx := retryable.NewContext()
+
+			_, err = c.DoWithContext(ctx, req)
+			if test.expectError == (err == nil) {
+				t.Errorf("expected: %v, received %#v", test.expectError, err)
+			}
+
+			attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+			if test.expectAttempts != attempts {
+				t.Errorf("expected %d, received %d", test.expectAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_Hedging(t *testing.T) {
+	for _, test := range []struct {
+		method       string
+		expectHedged bool
+	}{
+		{http.MethodGet, true},
+		{http.MethodPost, false},
+	} {
+		t.Run(test.method, func(t *testing.T) {
+			var (
+				calls     atomic.Int32
+				cancelled = make(chan struct{})
+			)
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if calls.Add(1) == 1 {
+					// Be slow enough that a hedge is sent
+					select {
+					case <-r.Context().Done():
+						close(cancelled)
+					case <-time.After(500 * time.Millisecond):
+					}
+
+					return
+				}
+
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer ts.Close()
+
+			req, err := http.NewRequest(test.method, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.New()
+			c.HedgeDelay = 10 * time.Millisecond
+			c.HedgeCount = 2
+
+			start := time.Now()
+
+			resp, err := c.DoWithContext(retryable.NewContext(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hedged := time.Since(start) < 250*time.Millisecond
+			if test.expectHedged != hedged {
+				t.Errorf("expected hedged %v, took %s", test.expectHedged, time.Since(start))
+			}
+
+			if test.expectHedged {
+				select {
+				case <-cancelled:
+				case <-time.After(time.Second):
+					t.Error("expected the slow request to be cancelled")
+				}
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_Hedging_MaxTotalRequests(t *testing.T) {
+	var calls atomic.Int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		_, _ = io.Copy(io.Discard, r.Body)
+
+		// Slow enough that every hedge would be sent, were it allowed
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	req, err := retryable.NewRequest(http.MethodPut, ts.URL, strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := retryable.New()
+	c.HedgeDelay = 10 * time.Millisecond
+	c.HedgeCount = 3
+	c.MaxTotalRequests = 2
+
+	ctx := retryable.NewContext()
+
+	resp, err := c.DoWithContext(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = resp.Body.Close()
+
+	if n := calls.Load(); n != 2 {
+		t.Errorf("expected 2 requests, received %d", n)
+	}
+
+	// Hedged copies send their bodies too
+	stats, _ := retryable.TransferStatsFromContext(ctx)
+	if stats.BytesSent != 10 {
+		t.Errorf("expected 10 bytes sent, received %d", stats.BytesSent)
+	}
+}
+
+func TestHttpClient_DoWithContext_TerminationReason(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		resp           int
+		maxRetries     int
+		maxElapsedTime time.Duration
+		cancel         bool
+		expect         retryable.Reason
+	}{
+		{"Success", http.StatusOK, 1, 0, false, retryable.ReasonSuccess},
+		{"Permanent", http.StatusNotFound, 1, 0, false, retryable.ReasonPermanent},
+		{"Max retries", http.StatusInternalServerError, 1, 0, false, retryable.ReasonMaxRetries},
+		{"Max elapsed", http.StatusInternalServerError, 0, time.Millisecond, false, retryable.ReasonMaxElapsed},
+		{"Context cancelled", http.StatusInternalServerError, 1, 0, true, retryable.ReasonContextCancelled},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.resp)
+			}))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.New(retryable.WithInstantBackoff())
+			c.MaxRetries = test.maxRetries
+			c.MaxElapsedTime = test.maxElapsedTime
+
+			ctx, cancel := context.WithCancel(retryable.NewContext())
+			if test.cancel {
+				cancel()
+			}
+			defer cancel()
+
+			_, _ = c.DoWithContext(ctx, req)
+
+			reason, ok := retryable.TerminationReasonFromContext(ctx)
+			if !ok {
+				t.Fatal("expected `reason` in the context")
+			}
+
+			if test.expect != reason {
+				t.Errorf("expected %q, received %q", test.expect, reason)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_WithMultipartRequest(t *testing.T) {
+	var calls int
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+
+		if calls < 3 {
+			// Read a little of the body, before falling over
+			_, _ = r.Body.Read(make([]byte, 8))
+
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		err := r.ParseMultipartForm(1 << 20)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if r.FormValue("name") != "scan" {
+			t.Errorf("unexpected field value %q", r.FormValue("name"))
+		}
+
+		f, _, err := r.FormFile("upload")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := io.ReadAll(f)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if string(b) != "some file contents" {
+			t.Errorf("unexpected file contents %q", b)
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	req, err := retryable.NewMultipartRequest(http.MethodPost, ts.URL,
+		map[string]string{"name": "scan"},
+		map[string]io.Reader{"upload": bytes.NewBufferString("some file contents")},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := retryable.New(retryable.WithInstantBackoff())
+
+	_, err = c.DoWithContext(context.Background(), req)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if calls != 3 {
+		t.Errorf("expected 3 requests, received %d", calls)
+	}
+}
+
+// TestHttpClient_DoWithContext_MaxBackoffTotal tests that MaxBackoffTotal caps time
+// spent sleeping; against a server which fails immediately, that's near enough all of it
+func TestHttpClient_DoWithContext_MaxBackoffTotal(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		requestTime time.Duration
+	}{
+		{"Fast server", 0},
+		// Requests alone take longer than the cap, which only counts the sleeps
+		{"Slow server", 2 * time.Second},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			clock := retryable.NewTestClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+
+			rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				clock.Advance(test.requestTime)
+
+				return &http.Response{
+					Status:     "500 Internal Server Error",
+					StatusCode: http.StatusInternalServerError,
+					Body:       http.NoBody,
+					Request:    req,
+				}, nil
+			})
+
+			req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.NewWithTransport(rt, retryable.WithTestClock(clock))
+			c.MaxRetries = 0
+			c.MaxBackoffTotal = time.Second
+			c.InitialInterval = 100 * time.Millisecond
+			c.Multiplier = 2
+			c.JitterStrategy = retryable.NoJitter
+
+			ctx := retryable.NewContext()
+
+			_, err = c.DoWithContext(ctx, req)
+			if err == nil {
+				t.Error("expected request to fail due to MaxBackoffTotal exceeded")
+			}
+
+			// Sleeps of 100ms, 200ms, and 400ms fit; another of 800ms doesn't
+			attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+			if attempts != 4 {
+				t.Errorf("expected 4 attempts, got %d", attempts)
+			}
+
+			reason, _ := retryable.TerminationReasonFromContext(ctx)
+			if reason != retryable.ReasonMaxBackoffTotal {
+				t.Errorf("expected %q, received %q", retryable.ReasonMaxBackoffTotal, reason)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_TraceConnections(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := retryable.NewWithTransport(ts.Client().Transport)
+	c.TraceConnections = true
+
+	ctx := retryable.NewContext()
+
+	resp, err := c.DoWithContext(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = resp.Body.Close()
+
+	timing, ok := retryable.ConnectionTimingFromContext(ctx)
+	if !ok {
+		t.Fatal("expected `timing` in the context")
+	}
+
+	// The test server listens on an IP, so there's no DNS to time
+	if timing.TCPConnect == 0 {
+		t.Error("expected TCP connect time to be recorded")
+	}
+
+	if timing.TLSHandshake == 0 {
+		t.Error("expected TLS handshake time to be recorded")
+	}
+
+	if timing.TimeToFirstByte == 0 {
+		t.Error("expected time to first byte to be recorded")
+	}
+}
+
+func TestHttpClient_DoWithContext_MaxAttempts(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		client      *retryable.HttpClient
+		expectCalls int
+	}{
+		{"MaxRetries doesn't count the first attempt", &retryable.HttpClient{MaxRetries: 2}, 3},
+		{"MaxAttempts does", &retryable.HttpClient{MaxAttempts: 2}, 2},
+		{"MaxAttempts wins", &retryable.HttpClient{MaxRetries: 5, MaxAttempts: 1}, 1},
+		{"WithMaxAttempts sets MaxAttempts", retryable.New(retryable.WithMaxAttempts(4)), 4},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+
+				w.WriteHeader(http.StatusInternalServerError)
+			}))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := test.client
+			c.Client = http.DefaultClient
+			c.MaxInterval = time.Millisecond
+
+			ctx := retryable.NewContext()
+
+			_, err = c.DoWithContext(ctx, req)
+			if !errors.As(err, new(retryable.MaxAttemptsReachedError)) {
+				t.Errorf("unexpected error %#v", err)
+			}
+
+			if test.expectCalls != calls {
+				t.Errorf("expected %d calls, received %d", test.expectCalls, calls)
+			}
+
+			attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+			if test.expectCalls != attempts {
+				t.Errorf("expected %d attempts, received %d", test.expectCalls, attempts)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_ExponentialOn429WithoutHeader(t *testing.T) {
+	ft := faulttransport.New(
+		faulttransport.Status(http.StatusTooManyRequests),
+		faulttransport.Status(http.StatusTooManyRequests),
+		faulttransport.Status(http.StatusOK),
+	)
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := retryable.NewWithTransport(ft, retryable.WithInstantBackoff())
+	c.ExponentialOn429WithoutHeader = true
+
+	start := time.Now()
+
+	_, err = c.DoWithContext(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two fixed waits would take two seconds; with a tiny MaxInterval the exponential
+	// schedule takes well under one
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the exponential schedule to be used, took %s", elapsed)
+	}
+}
+
+type failingLimiter struct{ err error }
+
+func (l failingLimiter) Wait(context.Context, string) error { return l.err }
+
+type recordingLimiter struct{ operations []string }
+
+func (l *recordingLimiter) Wait(ctx context.Context, _ string) error {
+	op, _ := retryable.OperationFromContext(ctx)
+	l.operations = append(l.operations, op)
+
+	return nil
+}
+
+func TestHttpClient_DoWithContext_Limiter(t *testing.T) {
+	ft := faulttransport.New()
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := errors.New("over budget")
+
+	c := retryable.NewWithTransport(ft)
+	c.Limiter = failingLimiter{err: expect}
+
+	_, err = c.DoWithContext(context.Background(), req)
+	if !errors.Is(err, expect) {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	if ft.Requests() != 0 {
+		t.Errorf("expected no requests to be made, received %d", ft.Requests())
+	}
+}
+
+func TestHttpClient_DoWithContext_CaptureHeaders(t *testing.T) {
+	var calls int
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+
+		w.Header().Set("X-Trace-Id", fmt.Sprintf("trace-%d", calls))
+		w.Header().Set("X-Uninteresting", "yawn")
+
+		if calls == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := retryable.New(retryable.WithInstantBackoff())
+	c.CaptureHeaders = []string{"x-trace-id", "Server"}
+
+	ctx := retryable.NewContext()
+
+	_, err = c.DoWithContext(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers, ok := retryable.CapturedHeadersFromContext(ctx)
+	if !ok {
+		t.Fatal("expected `headers` in the context")
+	}
+
+	expect := http.Header{"X-Trace-Id": []string{"trace-2"}}
+	if !reflect.DeepEqual(expect, headers) {
+		t.Errorf("expected %v, received %v", expect, headers)
+	}
+}
+
+func TestHttpClient_DoWithContext_SafeToRetryHeader(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		method         string
+		header         string
+		expectAttempts int
+	}{
+		{"Idempotent methods are always retried", http.MethodPut, "", 2},
+		{"POSTs aren't retried without the header", http.MethodPost, "", 1},
+		{"POSTs aren't retried with a falsy header", http.MethodPost, "false", 1},
+		{"POSTs are retried with a truthy header", http.MethodPost, "true", 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if test.header != "" {
+					w.Header().Set("X-Idempotent", test.header)
+				}
+
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			defer ts.Close()
+
+			req, err := http.NewRequest(test.method, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.New(retryable.WithInstantBackoff())
+			c.MaxRetries = 1
+			c.SafeToRetryHeader = "X-Idempotent"
+
+			ctx := retryable.NewContext()
+
+			resp, err := c.DoWithContext(ctx, req)
+			if err == nil {
+				t.Error("expected an error")
+			}
+
+			if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("expected the failed response to be returned, received %#v", resp)
+			}
+
+			attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+			if test.expectAttempts != attempts {
+				t.Errorf("expected %d, received %d", test.expectAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_ContextWithMaxRetries(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := retryable.New(retryable.WithInstantBackoff())
+	c.MaxAttempts = 1
+
+	ctx := retryable.ContextWithMaxRetries(retryable.NewContext(), 2)
+
+	_, err = c.DoWithContext(ctx, req)
+	if err == nil {
+		t.Error("expected an error")
+	}
+
+	attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+	if attempts != 3 {
+		t.Errorf("expected 3, received %d", attempts)
+	}
+}
+
+func TestHttpClient_DoWithContext_TransferStats(t *testing.T) {
+	var calls int
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+
+		_, err := io.Copy(io.Discard, r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if calls < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, "this error body isn't counted")
+
+			return
+		}
+
+		fmt.Fprint(w, "0123456789")
+	}))
+	defer ts.Close()
+
+	payload := "hello, world!"
+
+	req, err := retryable.NewRequest(http.MethodPost, ts.URL, bytes.NewBufferString(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := retryable.New(retryable.WithInstantBackoff())
+
+	ctx := retryable.NewContext()
+
+	resp, err := c.DoWithContext(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = resp.Body.Close()
+
+	stats, ok := retryable.TransferStatsFromContext(ctx)
+	if !ok {
+		t.Fatal("expected `stats` in the context")
+	}
+
+	// Uploads count every attempt; downloads only the one we got back
+	expect := retryable.TransferStats{BytesSent: int64(3 * len(payload)), BytesReceived: 10}
+	if expect != stats {
+		t.Errorf("expected %+v, received %+v", expect, stats)
+	}
+}
+
+func TestHttpClient_DoWithContext_InformationalResponses(t *testing.T) {
+	ft := faulttransport.New(faulttransport.Status(http.StatusEarlyHints))
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := retryable.NewWithTransport(ft)
+	ctx := retryable.NewContext()
+
+	resp, err := c.DoWithContext(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusEarlyHints {
+		t.Errorf("expected %d, received %d", http.StatusEarlyHints, resp.StatusCode)
+	}
+
+	attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+	if attempts != 1 {
+		t.Errorf("expected 1 attempt, received %d", attempts)
+	}
+}
+
+func TestHttpClient_DoWithContext_ContextWithOperation(t *testing.T) {
+	ft := faulttransport.New(faulttransport.Status(http.StatusBadGateway), faulttransport.Status(http.StatusOK))
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := new(recordingLimiter)
+
+	c := retryable.NewWithTransport(ft, retryable.WithInstantBackoff())
+	c.Limiter = l
+
+	events := c.Subscribe()
+	ctx := retryable.ContextWithOperation(retryable.NewContext(), "fetch-config")
+
+	_, err = c.DoWithContext(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Unsubscribe(events)
+
+	expect := []string{"fetch-config", "fetch-config"}
+	if !reflect.DeepEqual(expect, l.operations) {
+		t.Errorf("expected %v, received %v", expect, l.operations)
+	}
+
+	var retried []string
+	for ev := range events {
+		retried = append(retried, ev.Operation)
+	}
+
+	if !reflect.DeepEqual(expect[:1], retried) {
+		t.Errorf("expected retry events for %v, received %v", expect[:1], retried)
+	}
+}
+
+func TestHttpClient_Subscribe(t *testing.T) {
+	ft := faulttransport.New(
+		faulttransport.Status(http.StatusBadGateway),
+		faulttransport.Error(faulttransport.ErrConnectionReset),
+		faulttransport.Status(http.StatusOK),
+	)
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := retryable.NewWithTransport(ft, retryable.WithInstantBackoff())
+
+	events := c.Subscribe()
+
+	_, err = c.DoWithContext(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Unsubscribe(events)
+
+	var received []retryable.RetryEvent
+	for ev := range events {
+		received = append(received, ev)
+	}
+
+	if len(received) != 2 {
+		t.Fatalf("expected 2 events, received %d", len(received))
+	}
+
+	for i, expect := range []struct {
+		attempt int
+		status  int
+	}{
+		{1, http.StatusBadGateway},
+		{2, 0},
+	} {
+		ev := received[i]
+
+		if ev.Host != "example.com" || ev.Attempt != expect.attempt || ev.Status != expect.status || ev.Err == nil || ev.Delay == 0 {
+			t.Errorf("unexpected event %+v", ev)
+		}
+	}
+}
+
+// roundTripperFunc allows plain functions to be used as transports
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestHttpClient_DoWithContext_VerifyContentLength(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		body        string
+		expectError bool
+	}{
+		{"Complete bodies read cleanly", "0123456789", false},
+		{"Truncated bodies error", "0123", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode:    http.StatusOK,
+					Status:        "200 OK",
+					Header:        make(http.Header),
+					ContentLength: 10,
+					Body:          io.NopCloser(bytes.NewBufferString(test.body)),
+					Request:       req,
+				}, nil
+			})
+
+			req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.NewWithTransport(rt)
+			c.VerifyContentLength = true
+
+			resp, err := c.DoWithContext(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = io.ReadAll(resp.Body)
+			if test.expectError != errors.As(err, new(retryable.TruncatedBodyError)) {
+				t.Errorf("expected error: %v, received %#v", test.expectError, err)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoAll(t *testing.T) {
+	var inflight, peak atomic.Int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inflight.Add(1)
+		defer inflight.Add(-1)
+
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+
+		time.Sleep(10 * time.Millisecond)
+
+		w.WriteHeader(map[string]int{
+			"/ok":      http.StatusOK,
+			"/missing": http.StatusNotFound,
+		}[r.URL.Path])
+	}))
+	defer ts.Close()
+
+	var reqs []*http.Request
+
+	for _, path := range []string{"/ok", "/missing", "/ok", "/ok", "/missing", "/ok"} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reqs = append(reqs, req)
+	}
+
+	c := retryable.New()
+	c.DoAllWorkers = 2
+
+	results := c.DoAll(context.Background(), reqs)
+	if len(results) != len(reqs) {
+		t.Fatalf("expected %d results, received %d", len(reqs), len(results))
+	}
+
+	for i, res := range results {
+		if res.Response.Request.URL.Path != reqs[i].URL.Path {
+			t.Errorf("%d: results are out of order", i)
+		}
+
+		if (reqs[i].URL.Path == "/missing") != (res.Err != nil) {
+			t.Errorf("%d: unexpected error %#v", i, res.Err)
+		}
+
+		if res.Attempts != 1 {
+			t.Errorf("%d: expected 1 attempt, received %d", i, res.Attempts)
+		}
+
+		_ = res.Response.Body.Close()
+	}
+
+	if p := peak.Load(); p > 2 {
+		t.Errorf("expected at most 2 requests in flight, saw %d", p)
+	}
+}
+
+func TestHttpClient_Warmup(t *testing.T) {
+	var conns atomic.Int32
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	c := retryable.NewWithTransport(ts.Client().Transport)
+
+	err := c.Warmup(context.Background(), ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := c.DoWithContext(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = resp.Body.Close()
+
+	if n := conns.Load(); n != 1 {
+		t.Errorf("expected the warmed up connection to be reused, but %d were opened", n)
+	}
+}
+
+func TestHttpClient_DoWithContext_HonorRedirectRetryAfter(t *testing.T) {
+	for _, test := range []struct {
+		honor       bool
+		expectPaths []string
+	}{
+		{false, []string{"/", "/elsewhere"}},
+		{true, []string{"/", "/"}},
+	} {
+		t.Run(fmt.Sprint(test.honor), func(t *testing.T) {
+			var paths []string
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				paths = append(paths, r.URL.Path)
+
+				if len(paths) == 1 {
+					w.Header().Set("Location", "/elsewhere")
+					w.Header().Set("Retry-After", "0")
+					w.WriteHeader(http.StatusTemporaryRedirect)
+
+					return
+				}
+
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.New()
+			c.HonorRedirectRetryAfter = test.honor
+
+			_, err = c.DoWithContext(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(test.expectPaths, paths) {
+				t.Errorf("expected %v, received %v", test.expectPaths, paths)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_MaxRedirects(t *testing.T) {
+	for _, test := range []struct {
+		maxRedirects int
+		expectError  bool
+		expectHits   int
+	}{
+		{0, false, 4},
+		{3, false, 4},
+		{2, true, 3},
+	} {
+		t.Run(fmt.Sprint(test.maxRedirects), func(t *testing.T) {
+			var hits int
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits++
+
+				if hits < 4 {
+					http.Redirect(w, r, "/"+strconv.Itoa(hits), http.StatusFound)
+
+					return
+				}
+
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.New(retryable.WithInstantBackoff())
+			c.MaxRedirects = test.maxRedirects
+
+			_, err = c.DoWithContext(context.Background(), req)
+			if test.expectError != (err != nil) {
+				t.Errorf("expected error %v, received %v", test.expectError, err)
+			}
+
+			if test.expectHits != hits {
+				t.Errorf("expected %d, received %d", test.expectHits, hits)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_PauseOnRedirectRetryAfter(t *testing.T) {
+	for _, test := range []struct {
+		pause       bool
+		expectPause bool
+	}{
+		{false, false},
+		{true, true},
+	} {
+		t.Run(fmt.Sprint(test.pause), func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/" {
+					w.Header().Set("Retry-After", "1")
+					http.Redirect(w, r, "/elsewhere", http.StatusFound)
+
+					return
+				}
+
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.New()
+			c.PauseOnRedirectRetryAfter = test.pause
+			c.MaxRetryAfter = 100 * time.Millisecond
+
+			start := time.Now()
+
+			resp, err := c.DoWithContext(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Request.URL.Path != "/elsewhere" {
+				t.Errorf("expected the redirect to be followed, ended up at %q", resp.Request.URL.Path)
+			}
+
+			paused := time.Since(start) >= c.MaxRetryAfter
+			if test.expectPause != paused {
+				t.Errorf("expected pause %v, received %v", test.expectPause, paused)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_MaxConcurrent(t *testing.T) {
+	var inflight, peak atomic.Int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inflight.Add(1)
+		defer inflight.Add(-1)
+
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+
+		time.Sleep(10 * time.Millisecond)
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	c := retryable.New()
+	c.MaxConcurrent = 3
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Error(err)
+
+				return
+			}
+
+			resp, err := c.DoWithContext(context.Background(), req)
+			if err != nil {
+				t.Error(err)
+
+				return
+			}
+
+			_ = resp.Body.Close()
+		}()
+	}
+
+	wg.Wait()
+
+	if p := peak.Load(); p > 3 {
+		t.Errorf("expected at most 3 requests in flight, saw %d", p)
+	}
+}
+
+// droppingListener resets the first n connections it accepts, before they can even
+// get as far as a TLS handshake
+type droppingListener struct {
+	net.Listener
+	n atomic.Int32
+}
+
+func (l *droppingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil || l.n.Add(-1) < 0 {
+			return conn, err
+		}
+
+		if tc, ok := conn.(*net.TCPConn); ok {
+			_ = tc.SetLinger(0)
+		}
+
+		_ = conn.Close()
+	}
+}
+
+func TestHttpClient_DoWithContext_TLSHandshakeFailures(t *testing.T) {
+	t.Run("Dropped handshakes are retried", func(t *testing.T) {
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		l := &droppingListener{Listener: ts.Listener}
+		l.n.Store(2)
+
+		ts.Listener = l
+		ts.StartTLS()
+		defer ts.Close()
+
+		req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := retryable.NewWithTransport(ts.Client().Transport, retryable.WithInstantBackoff())
+
+		ctx := retryable.NewContext()
+
+		_, err = c.DoWithContext(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+		if attempts != 3 {
+			t.Errorf("expected 3 attempts, received %d", attempts)
+		}
+	})
+
+	t.Run("Untrusted certificates fail early", func(t *testing.T) {
+		ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		ts.Config.ErrorLog = log.New(io.Discard, "", 0)
+		defer ts.Close()
+
+		req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := retryable.New()
+		ctx := retryable.NewContext()
+
+		_, err = c.DoWithContext(ctx, req)
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+
+		attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+		if attempts != 1 {
+			t.Errorf("expected 1 attempt, received %d", attempts)
+		}
+	})
+}
+
+func TestHttpClient_DoWithContext_IdempotencyStore(t *testing.T) {
+	var calls int
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	c := retryable.New()
+	c.Store = retryable.NewMemoryIdempotencyStore()
+
+	for i, expect := range []struct {
+		key      string
+		status   int
+		attempts int
+	}{
+		{"abc", http.StatusCreated, 1},
+		{"abc", http.StatusOK, 0},
+		{"def", http.StatusCreated, 1},
+		{"", http.StatusCreated, 1},
+		{"", http.StatusCreated, 1},
+	} {
+		req, err := http.NewRequest(http.MethodPost, ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expect.key != "" {
+			req.Header.Set(retryable.IdempotencyKeyHeader, expect.key)
+		}
+
+		ctx := retryable.NewContext()
+
+		resp, err := c.DoWithContext(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != expect.status {
+			t.Errorf("%d: expected status %d, received %d", i, expect.status, resp.StatusCode)
+		}
+
+		if attempts, _ := retryable.NumberOfAttemptsFromContext(ctx); attempts != expect.attempts {
+			t.Errorf("%d: expected %d attempts, received %d", i, expect.attempts, attempts)
+		}
+	}
+
+	if calls != 4 {
+		t.Errorf("expected 4 calls, received %d", calls)
+	}
+}
+
+func TestHttpClient_DoWithContext_UserAgent(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		ua     string
+		expect string
+	}{
+		{"Unset user agents are set", "", "scanner/1.2.3"},
+		{"Explicit user agents are left alone", "curl/8.0", "curl/8.0"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var received []string
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received = append(received, r.UserAgent())
+
+				if len(received) == 1 {
+					w.WriteHeader(http.StatusBadGateway)
+
+					return
+				}
+
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.ua != "" {
+				req.Header.Set("User-Agent", test.ua)
+			}
+
+			c := retryable.New(retryable.WithInstantBackoff())
+			c.UserAgent = "scanner/1.2.3"
+
+			_, err = c.DoWithContext(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expect := []string{test.expect, test.expect}
+			if !reflect.DeepEqual(expect, received) {
+				t.Errorf("expected %v, received %v", expect, received)
+			}
+
+			if ua := req.Header.Get("User-Agent"); ua != test.ua {
+				t.Errorf("expected the caller's request to be untouched, received %q", ua)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_RetryOnBodyContains(t *testing.T) {
+	var calls int
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+
+		if calls < 3 {
+			fmt.Fprint(w, `{"error": "busy, please try again"}`)
+
+			return
+		}
+
+		fmt.Fprint(w, `{"result": 42}`)
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := retryable.New(retryable.WithInstantBackoff())
+	c.RetryOnBodyContains = []string{"try again"}
+
+	resp, err := c.DoWithContext(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != `{"result": 42}` {
+		t.Errorf("unexpected body %q", b)
+	}
+
+	if calls != 3 {
+		t.Errorf("expected 3 calls, received %d", calls)
+	}
+}
+
+func TestHttpClient_DoWithContext_RetryOnEmptyBody(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		method       string
+		emptyStatus  int
+		chunked      bool
+		expectCalls  int
+		expectBody   string
+		expectStatus int
+	}{
+		{"Empty 200s are retried until the body turns up", http.MethodGet, http.StatusOK, false, 3, `{"result": 42}`, http.StatusOK},
+		{"Empty chunked 200s are retried too", http.MethodGet, http.StatusOK, true, 3, `{"result": 42}`, http.StatusOK},
+		{"204s are empty by design", http.MethodGet, http.StatusNoContent, false, 1, "", http.StatusNoContent},
+		{"HEAD responses are empty by design", http.MethodHead, http.StatusOK, false, 1, "", http.StatusOK},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+
+				if calls < 3 {
+					w.WriteHeader(test.emptyStatus)
+
+					if test.chunked {
+						w.(http.Flusher).Flush()
+					}
+
+					return
+				}
+
+				fmt.Fprint(w, `{"result": 42}`)
+			}))
+			defer ts.Close()
+
+			req, err := http.NewRequest(test.method, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.New(retryable.WithInstantBackoff())
+			c.RetryOnEmptyBody = true
+
+			resp, err := c.DoWithContext(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer resp.Body.Close()
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(b) != test.expectBody {
+				t.Errorf("expected body %q, received %q", test.expectBody, b)
+			}
+
+			if resp.StatusCode != test.expectStatus {
+				t.Errorf("expected %d, received %d", test.expectStatus, resp.StatusCode)
+			}
+
+			if calls != test.expectCalls {
+				t.Errorf("expected %d calls, received %d", test.expectCalls, calls)
+			}
+		})
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	rewindable, err := retryable.NewRequest(http.MethodPost, "http://example.com", bytes.NewBufferString("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oneShot, err := http.NewRequest(http.MethodPost, "http://example.com", io.NopCloser(bytes.NewBufferString("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noBody, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relative, err := http.NewRequest(http.MethodGet, "/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name                string
+		req                 *http.Request
+		expectError         bool
+		expectNotRewindable bool
+	}{
+		{"Rewindable body is fine", rewindable, false, false},
+		{"No body is fine", noBody, false, false},
+		{"One-shot body fails", oneShot, true, true},
+		{"Relative URL fails", relative, true, false},
+		{"Nil request fails", nil, true, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := retryable.ValidateRequest(test.req)
+			if test.expectError == (err == nil) {
+				t.Errorf("expected error: %v, received %#v", test.expectError, err)
+			}
+
+			if test.expectNotRewindable != errors.Is(err, retryable.ErrBodyNotRewindable) {
+				t.Errorf("expected ErrBodyNotRewindable: %v, received %#v", test.expectNotRewindable, err)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_SuccessPredicate(t *testing.T) {
+	var calls int
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+
+		if calls < 3 {
+			w.WriteHeader(http.StatusOK)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := retryable.New(retryable.WithInstantBackoff())
+	c.SuccessPredicate = func(resp *http.Response) bool {
+		return resp.StatusCode == http.StatusCreated
+	}
+
+	resp, err := c.DoWithContext(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("expected %d, received %d", http.StatusCreated, resp.StatusCode)
+	}
+
+	if calls != 3 {
+		t.Errorf("expected 3 calls, received %d", calls)
+	}
+}
+
+func TestSuccessfulAttemptFromContext(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		failures      int
+		expectAttempt int
+		expectOK      bool
+	}{
+		{"Success first time", 0, 1, true},
+		{"Success after failures", 2, 3, true},
+		{"Failure throughout", 10, 0, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+
+				if calls <= test.failures {
+					w.WriteHeader(http.StatusInternalServerError)
+
+					return
+				}
+
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.New(retryable.WithInstantBackoff())
+			c.MaxAttempts = 4
+
+			ctx := retryable.NewContext()
+
+			_, _ = c.DoWithContext(ctx, req)
+
+			attempt, ok := retryable.SuccessfulAttemptFromContext(ctx)
+			if test.expectOK != ok {
+				t.Errorf("expected %v, received %v", test.expectOK, ok)
+			}
+
+			if test.expectAttempt != attempt {
+				t.Errorf("expected %d, received %d", test.expectAttempt, attempt)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_WithChunkedRequest(t *testing.T) {
+	var (
+		bodies []string
+		calls  int
+	)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+
+		if len(r.TransferEncoding) == 0 || r.TransferEncoding[0] != "chunked" {
+			t.Errorf("expected chunked transfer encoding, received %v", r.TransferEncoding)
+		}
+
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		bodies = append(bodies, string(b))
+
+		if calls < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	payload := `{"msg":"hello, world!"}`
+
+	req, err := retryable.NewChunkedRequest(http.MethodPost, ts.URL, bytes.NewBufferString(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := retryable.New(retryable.WithInstantBackoff())
+
+	_, err = c.DoWithContext(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{payload, payload, payload}
+	if !reflect.DeepEqual(expect, bodies) {
+		t.Errorf("expected %q, received %q", expect, bodies)
+	}
+}
+
+func TestHttpClient_DoWithContext_UnprocessedHTTP2Errors(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		err            error
+		expectAttempts int
+	}{
+		{"GOAWAY is retried", errors.New(`http2: server sent GOAWAY and closed the connection; LastStreamID=1, ErrCode=NO_ERROR, debug=""`), 2},
+		{"REFUSED_STREAM is retried", errors.New("stream error: stream ID 3; REFUSED_STREAM"), 2},
+		{"Other stream errors are not", errors.New("stream error: stream ID 3; INTERNAL_ERROR"), 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := retryable.NewWithTransport(roundTripperFunc(func(*http.Request) (*http.Response, error) {
+				return nil, test.err
+			}), retryable.WithInstantBackoff())
+			c.MaxAttempts = 2
+			c.SafeToRetryHeader = "X-Idempotent"
+
+			req, err := http.NewRequest(http.MethodPost, "http://example.com", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := retryable.NewContext()
+
+			_, err = c.DoWithContext(ctx, req)
+			if err == nil {
+				t.Error("expected an error")
+			}
+
+			attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+			if test.expectAttempts != attempts {
+				t.Errorf("expected %d, received %d", test.expectAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2015, time.October, 21, 7, 28, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		name     string
+		header   string
+		expect   time.Duration
+		expectOK bool
+	}{
+		{"Seconds", "120", 2 * time.Minute, true},
+		{"Zero seconds", "0", 0, true},
+		{"HTTP-date in the future", "Wed, 21 Oct 2015 07:30:00 GMT", 2 * time.Minute, true},
+		{"HTTP-date in the past", "Wed, 21 Oct 2015 07:00:00 GMT", 0, true},
+		{"Empty", "", 0, false},
+		{"Nonsense", "soon", 0, false},
+		{"Surrounding whitespace", " 120\t", 2 * time.Minute, true},
+		{"Only whitespace", "  ", 0, false},
+		{"Negative seconds", "-120", 0, false},
+		{"Signed seconds", "+120", 0, false},
+		{"Fractional seconds", "1.5", 0, false},
+		{"Seconds beyond a year", "99999999", 365 * 24 * time.Hour, true},
+		{"Seconds overflowing a duration", "9999999999", 365 * 24 * time.Hour, true},
+		{"Seconds overflowing an integer", "99999999999999999999", 365 * 24 * time.Hour, true},
+		{"HTTP-date centuries away", "Fri, 31 Dec 9999 23:59:59 GMT", 365 * 24 * time.Hour, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			d, ok := retryable.ParseRetryAfter(test.header, now)
+			if test.expectOK != ok {
+				t.Errorf("expected %v, received %v", test.expectOK, ok)
+			}
+
+			if test.expect != d {
+				t.Errorf("expected %s, received %s", test.expect, d)
+			}
+		})
+	}
+}
+
+func FuzzParseRetryAfter(f *testing.F) {
+	for _, seed := range []string{
+		"120", "0", "", " 120 ", "-1", "+1", "1.5", "1e9",
+		"99999999999999999999", "9223372036854775807", "18446744073709551616",
+		"Wed, 21 Oct 2015 07:28:00 GMT", "Fri, 31 Dec 9999 23:59:59 GMT", "Sunday, 06-Nov-94 08:49:37 GMT",
+	} {
+		f.Add(seed)
+	}
+
+	now := time.Date(2015, time.October, 21, 7, 28, 0, 0, time.UTC)
+
+	f.Fuzz(func(t *testing.T, header string) {
+		d, ok := retryable.ParseRetryAfter(header, now)
+
+		if d < 0 || d > 365*24*time.Hour {
+			t.Errorf("%q: out of bounds delay %s", header, d)
+		}
+
+		if !ok && d != 0 {
+			t.Errorf("%q: unparseable header returned delay %s", header, d)
+		}
+	})
+}
+
+func TestHttpClient_DoWithContext_WithContentDigest(t *testing.T) {
+	var (
+		digests []string
+		calls   int
+	)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+
+		digests = append(digests, r.Header.Get("Content-Digest"))
+
+		_, err := io.Copy(io.Discard, r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if calls < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	req, err := retryable.NewRequest(http.MethodPut, ts.URL, bytes.NewBufferString("hello"), retryable.WithContentDigest(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := retryable.New(retryable.WithInstantBackoff())
+
+	_, err = c.DoWithContext(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// echo -n hello | openssl dgst -sha256 -binary | base64
+	expect := "sha-256=:LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=:"
+	if !reflect.DeepEqual([]string{expect, expect, expect}, digests) {
+		t.Errorf("expected %q on every attempt, received %q", expect, digests)
+	}
+}
+
+func TestHttpClient_DoWithContext_MaxTotalRequests(t *testing.T) {
+	var calls int
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+
+		if calls == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	c := retryable.New(retryable.WithInstantBackoff())
+	c.MaxTotalRequests = 3
+
+	for i, expectError := range []bool{false, false, true} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = c.DoWithContext(context.Background(), req)
+		if expectError == (err == nil) {
+			t.Errorf("call %d: expected error: %v, received %#v", i, expectError, err)
+		}
+
+		if expectError && !errors.As(err, new(retryable.RequestQuotaExceededError)) {
+			t.Errorf("call %d: expected a RequestQuotaExceededError, received %#v", i, err)
+		}
+	}
+
+	if calls != 3 {
+		t.Errorf("expected 3 requests, received %d", calls)
+	}
+}
+
+func TestHttpClient_DoWithContext_NoClientState(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		client retryable.HttpClient
+	}{
+		{"MaxConcurrent", retryable.HttpClient{MaxConcurrent: 1}},
+		{"MaxTotalRequests", retryable.HttpClient{MaxTotalRequests: 1}},
+		{"SingleFlight", retryable.HttpClient{SingleFlight: true}},
+		{"Proxy", retryable.HttpClient{Proxy: http.ProxyFromEnvironment}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ft := faulttransport.New(faulttransport.Status(http.StatusOK))
+
+			c := test.client
+			c.Client = &http.Client{Transport: ft}
+
+			req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = c.DoWithContext(context.Background(), req)
+			if !errors.Is(err, retryable.ErrNoClientState) {
+				t.Errorf("unexpected error %#v", err)
+			}
+
+			if n := ft.Requests(); n != 0 {
+				t.Errorf("expected nothing to be sent, received %d requests", n)
+			}
+		})
+	}
+}
+
+func TestHttpClient_Pause(t *testing.T) {
+	var calls atomic.Int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	c := retryable.New(retryable.WithInstantBackoff())
+	c.Pause()
+
+	t.Run("paused calls wait for their context", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		_, err = c.DoWithContext(ctx, req)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected context.DeadlineExceeded, received %#v", err)
+		}
+	})
+
+	t.Run("paused calls proceed on resume", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan error)
+		go func() {
+			_, err := c.DoWithContext(context.Background(), req)
+			done <- err
+		}()
+
+		select {
+		case <-done:
+			t.Fatal("call returned while paused")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		c.Resume()
+
+		err = <-done
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected 1 request, received %d", n)
+	}
+}
+
+func TestHttpClient_DoWithContext_RetryableNetErrors(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		allowed        []error
+		err            error
+		expectAttempts int
+	}{
+		{"Everything is retried by default", nil, errors.New("boom"), 2},
+		{"Listed errors are retried", retryable.DefaultRetryableNetErrors, fmt.Errorf("read: %w", io.ErrUnexpectedEOF), 2},
+		{"Unlisted errors are not", retryable.DefaultRetryableNetErrors, errors.New("boom"), 1},
+		{"GOAWAY is retried, listed or not", retryable.DefaultRetryableNetErrors, errors.New(`http2: server sent GOAWAY and closed the connection; LastStreamID=1, ErrCode=NO_ERROR, debug=""`), 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := retryable.NewWithTransport(roundTripperFunc(func(*http.Request) (*http.Response, error) {
+				return nil, test.err
+			}), retryable.WithInstantBackoff())
+			c.MaxAttempts = 2
+			c.RetryableNetErrors = test.allowed
+
+			req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := retryable.NewContext()
+
+			_, err = c.DoWithContext(ctx, req)
+			if err == nil {
+				t.Error("expected an error")
+			}
+
+			attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+			if test.expectAttempts != attempts {
+				t.Errorf("expected %d, received %d", test.expectAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestNewForDuration(t *testing.T) {
+	total := 2 * time.Minute
+
+	c := retryable.NewForDuration(total)
+
+	if c.MaxElapsedTime != total {
+		t.Errorf("expected %s, received %s", total, c.MaxElapsedTime)
+	}
+
+	if c.MaxRetries != 0 || c.MaxAttempts != 0 {
+		t.Errorf("expected retries to be bounded by time alone, received %d retries, %d attempts", c.MaxRetries, c.MaxAttempts)
+	}
+
+	// Nine waits between ten attempts, without jitter or capping
+	var (
+		sum  time.Duration
+		wait = c.InitialInterval
+	)
+
+	for i := 0; i < 9; i++ {
+		sum += wait
+		wait = time.Duration(float64(wait) * c.Multiplier)
+	}
+
+	if sum < total*9/10 || sum > total {
+		t.Errorf("expected the schedule to add up to around %s, received %s", total, sum)
+	}
+
+	if c.InitialInterval <= 0 || c.InitialInterval > c.MaxInterval {
+		t.Errorf("unexpected InitialInterval %s for MaxInterval %s", c.InitialInterval, c.MaxInterval)
+	}
+}
+
+func TestNewForDuration_NonPositive(t *testing.T) {
+	for _, total := range []time.Duration{0, -time.Second} {
+		t.Run(total.String(), func(t *testing.T) {
+			ft := faulttransport.New(faulttransport.Status(http.StatusBadGateway))
+			ft.Repeat = true
+
+			c := retryable.NewForDuration(total)
+			c.Client = &http.Client{Transport: ft}
+
+			req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(retryable.NewContext(), time.Second)
+			defer cancel()
+
+			_, err = c.DoWithContext(ctx, req)
+			if !errors.Is(err, retryable.ErrMaxAttempts) {
+				t.Errorf("expected max attempts, received %v", err)
+			}
+
+			if n := ft.Requests(); n != 1 {
+				t.Errorf("expected a single attempt, received %d", n)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_MetadataReused(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-Id", "abc")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	ctx := retryable.NewContext()
+
+	c := retryable.New()
+	c.TraceConnections = true
+	c.CaptureHeaders = []string{"X-Request-Id"}
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := c.DoWithContext(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = resp.Body.Close()
+
+	// A second call, which gets none of those, mustn't report the first's
+	failing := retryable.NewWithTransport(faulttransport.New(faulttransport.Status(http.StatusNotFound)))
+
+	_, err = failing.DoWithContext(ctx, req)
+	if err == nil {
+		t.Fatal("expected a 404 to fail")
+	}
+
+	if d, _ := retryable.SuccessfulRequestDurationFromContext(ctx); d != 0 {
+		t.Errorf("expected no successful duration, received %s", d)
+	}
+
+	if timing, _ := retryable.ConnectionTimingFromContext(ctx); timing != (retryable.ConnTiming{}) {
+		t.Errorf("expected no connection timing, received %+v", timing)
+	}
+
+	if headers, _ := retryable.CapturedHeadersFromContext(ctx); headers != nil {
+		t.Errorf("expected no captured headers, received %v", headers)
+	}
+}
+
+func TestHttpClient_DoWithContext_MetadataWithoutNewContext(t *testing.T) {
+	var calls int
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+
+		if calls%2 == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	c := retryable.New(retryable.WithInstantBackoff())
+
+	t.Run("from the response's request", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := c.DoWithContext(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		attempts, ok := retryable.NumberOfAttemptsFromContext(resp.Request.Context())
+		if !ok {
+			t.Fatal("expected `attempts` in the response's request context")
+		}
+
+		if attempts != 2 {
+			t.Errorf("expected 2, received %d", attempts)
+		}
+	})
+
+	t.Run("from a request seeded with ContextWithMetadata", func(t *testing.T) {
+		ctx := retryable.ContextWithMetadata(context.Background())
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = c.DoWithContext(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		attempts, ok := retryable.NumberOfAttemptsFromContext(ctx)
+		if !ok {
+			t.Fatal("expected `attempts` in the context")
+		}
+
+		if attempts != 2 {
+			t.Errorf("expected 2, received %d", attempts)
+		}
+	})
+}
+
+func TestHttpClient_DoWithContext_Signer(t *testing.T) {
+	var (
+		signatures []string
+		calls      int
+	)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if expect := fmt.Sprintf("%d:%s", calls, b); r.Header.Get("X-Signature") != expect {
+			t.Errorf("expected signature %q, received %q", expect, r.Header.Get("X-Signature"))
+		}
+
+		signatures = append(signatures, r.Header.Get("X-Signature"))
+
+		if calls < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	req, err := retryable.NewRequest(http.MethodPut, ts.URL, bytes.NewBufferString("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var signed int
+
+	c := retryable.New(retryable.WithInstantBackoff())
+	c.Signer = func(req *http.Request) error {
+		signed++
+
+		// Sign over the body, as a body-signing scheme would
+		b, err := io.ReadAll(req.Body)
+		if err != nil {
+			return err
+		}
+
+		req.Header.Set("X-Signature", fmt.Sprintf("%d:%s", signed, b))
+
+		return nil
+	}
+
+	_, err = c.DoWithContext(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{"1:hello", "2:hello", "3:hello"}
+	if !reflect.DeepEqual(expect, signatures) {
+		t.Errorf("expected %q, received %q", expect, signatures)
+	}
+}
+
+func TestHttpClient_DoWithContext_DeadlineHeader(t *testing.T) {
+	deadline := time.Now().Add(150 * time.Millisecond)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Retry-Deadline", deadline.Format(time.RFC3339Nano))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := retryable.New()
+	c.MaxRetries = 0
+	c.JitterStrategy = retryable.NoJitter
+	c.InitialInterval = 40 * time.Millisecond
+	c.MaxInterval = 40 * time.Millisecond
+	c.DeadlineHeader = "X-Retry-Deadline"
+
+	ctx := retryable.NewContext()
+
+	_, err = c.DoWithContext(ctx, req)
+	if err == nil || err.Error() != "503 Service Unavailable" {
+		t.Errorf("expected the last error, received %#v", err)
+	}
+
+	if time.Now().After(deadline.Add(100 * time.Millisecond)) {
+		t.Errorf("expected to give up by the deadline")
+	}
+
+	reason, _ := retryable.TerminationReasonFromContext(ctx)
+	if reason != retryable.ReasonServerDeadline {
+		t.Errorf("expected %q, received %q", retryable.ReasonServerDeadline, reason)
+	}
+}
+
+func TestHttpClient_WaitForHealthy(t *testing.T) {
+	t.Run("waits until healthy", func(t *testing.T) {
+		var calls int
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+
+			if calls < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer ts.Close()
+
+		c := retryable.New()
+		c.MaxAttempts = 1 // Ignored
+
+		err := c.WaitForHealthy(context.Background(), ts.URL, time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if calls != 3 {
+			t.Errorf("expected 3 calls, received %d", calls)
+		}
+	})
+
+	t.Run("reuses its connection across failed probes", func(t *testing.T) {
+		var calls, connections atomic.Int32
+
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/missing":
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, "no such thing")
+
+			case calls.Add(1) < 3:
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprint(w, "starting up")
+			}
+		}))
+		ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				connections.Add(1)
+			}
+		}
+		ts.Start()
+		defer ts.Close()
+
+		c := retryable.New()
+
+		err := c.WaitForHealthy(context.Background(), ts.URL+"/missing", time.Millisecond)
+		if err == nil {
+			t.Fatal("expected a 404 to fail")
+		}
+
+		err = c.WaitForHealthy(context.Background(), ts.URL, time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n := connections.Load(); n != 1 {
+			t.Errorf("expected 1 connection, received %d", n)
+		}
+	})
+
+	t.Run("gives up with the context", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer ts.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		err := retryable.New().WaitForHealthy(ctx, ts.URL, 5*time.Millisecond)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected context.DeadlineExceeded, received %#v", err)
+		}
+	})
+
+	t.Run("polls at a fixed interval", func(t *testing.T) {
+		var calls int
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+
+			if calls < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer ts.Close()
+
+		c := retryable.New()
+		c.FastFirstRetry = true
+		c.ImmediateRetries = 2
+
+		// Ignored too, else we'd give up after the second call
+		ctx := retryable.ContextWithMaxRetries(context.Background(), 1)
+		start := time.Now()
+
+		err := c.WaitForHealthy(ctx, ts.URL, 20*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+			t.Errorf("expected to wait at least 40ms, waited %s", elapsed)
+		}
+
+		if calls != 3 {
+			t.Errorf("expected 3 calls, received %d", calls)
+		}
+	})
+
+	t.Run("refuses a non-positive interval", func(t *testing.T) {
+		ft := faulttransport.New(faulttransport.Status(http.StatusOK))
+
+		err := retryable.NewWithTransport(ft).WaitForHealthy(context.Background(), "http://example.com", 0)
+		if err == nil {
+			t.Error("expected an error")
+		}
+
+		if n := ft.Requests(); n != 0 {
+			t.Errorf("expected nothing to be sent, received %d requests", n)
+		}
+	})
+}
+
+func TestHttpClient_DoWithContext_RetryableStatusCodes(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		retryable      []int
+		expectAttempts int
+	}{
+		{"402s are permanent by default", nil, 1},
+		{"402s are retried when configured", []int{http.StatusPaymentRequired}, 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusPaymentRequired)
+			}))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.New(retryable.WithInstantBackoff())
+			c.MaxAttempts = 2
+			c.RetryableStatusCodes = test.retryable
+
+			ctx := retryable.NewContext()
+
+			_, err = c.DoWithContext(ctx, req)
+			if err == nil {
+				t.Error("expected an error")
+			}
+
+			attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+			if test.expectAttempts != attempts {
+				t.Errorf("expected %d, received %d", test.expectAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_AsyncPoll(t *testing.T) {
+	var polls int
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /jobs", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/jobs/1")
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("GET /jobs/1", func(w http.ResponseWriter, r *http.Request) {
+		polls++
+
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("expected the original headers to be carried over, received %v", r.Header)
+		}
+
+		if polls < 3 {
+			w.WriteHeader(http.StatusAccepted)
+
+			return
+		}
+
+		fmt.Fprint(w, "done")
+	})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	req, err := retryable.NewRequest(http.MethodPost, ts.URL+"/jobs", bytes.NewBufferString("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Authorization", "Bearer token")
+
+	c := retryable.New(retryable.WithInstantBackoff())
+	c.AsyncPoll = true
+
+	resp, err := c.DoWithContext(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK || string(b) != "done" {
+		t.Errorf("expected the final result of the job, received %s %q", resp.Status, b)
+	}
+
+	if polls != 3 {
+		t.Errorf("expected 3 polls, received %d", polls)
+	}
+}
+
+func TestHttpClient_DoWithContext_AsyncPoll_SuccessPredicate(t *testing.T) {
+	var polls int
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /jobs", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/jobs/1")
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("GET /jobs/1", func(w http.ResponseWriter, r *http.Request) {
+		polls++
+
+		if polls < 3 {
+			w.WriteHeader(http.StatusAccepted)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/jobs", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := retryable.New(retryable.WithInstantBackoff())
+	c.AsyncPoll = true
+
+	// The override still counts 202s as successes, but polls keep going on them
+	ctx := retryable.ContextWithSuccessPredicate(context.Background(), func(resp *http.Response) bool {
+		return resp.StatusCode/100 == 2
+	})
+
+	resp, err := c.DoWithContext(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the final result of the job, received %s", resp.Status)
+	}
+
+	if polls != 3 {
+		t.Errorf("expected 3 polls, received %d", polls)
+	}
+}
+
+func TestHttpClient_DoWithContext_AsyncPoll_CrossHost(t *testing.T) {
+	var received http.Header
+
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+
+		fmt.Fprint(w, "done")
+	}))
+	defer other.Close()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", other.URL+"/jobs/1")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	req, err := retryable.NewRequest(http.MethodPost, ts.URL+"/jobs", bytes.NewBufferString("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Proxy-Authorization", "Basic secret")
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("X-Request-Id", "abc")
+
+	c := retryable.New(retryable.WithInstantBackoff())
+	c.AsyncPoll = true
+
+	resp, err := c.DoWithContext(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	for _, k := range []string{"Authorization", "Proxy-Authorization", "Cookie"} {
+		if v := received.Get(k); v != "" {
+			t.Errorf("expected %s not to be sent to another host, received %q", k, v)
+		}
+	}
+
+	if v := received.Get("X-Request-Id"); v != "abc" {
+		t.Errorf("expected other headers to be carried over, received %q", v)
+	}
+}
+
+func TestHttpClient_DoWithContext_AsyncPoll_MaxConcurrent(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /jobs", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/jobs/1")
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("GET /jobs/1", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "done")
+	})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	req, err := retryable.NewRequest(http.MethodPost, ts.URL+"/jobs", bytes.NewBufferString("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := retryable.New(retryable.WithInstantBackoff())
+	c.AsyncPoll = true
+	c.MaxConcurrent = 1
+
+	// Polling mustn't wait on the slot held by the call which started it
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	resp, err := c.DoWithContext(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the final result of the job, received %s", resp.Status)
+	}
+
+	// Nor should the slot be given back twice, leaving room for two calls at once
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	defer slow.Close()
+
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			req, _ := http.NewRequest(http.MethodGet, slow.URL, nil)
+
+			resp, err := c.DoWithContext(context.Background(), req)
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+
+	<-started
+
+	select {
+	case <-started:
+		t.Error("expected calls to be made one at a time")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	wg.Wait()
+}
+
+func TestHttpClient_DoWithContext_CaptureErrorBody(t *testing.T) {
+	body := `{"error": "invalid widget"}`
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, body)
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := retryable.New()
+	c.CaptureErrorBody = true
+	c.MaxErrorBodyBytes = 10
+
+	ctx := retryable.NewContext()
+
+	resp, err := c.DoWithContext(ctx, req)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if expect := `400 Bad Request: {"error": `; err.Error() != expect {
+		t.Errorf("expected %q, received %q", expect, err.Error())
+	}
+
+	captured, _ := retryable.ErrorBodyFromContext(ctx)
+	if string(captured) != body[:10] {
+		t.Errorf("expected %q, received %q", body[:10], captured)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != body {
+		t.Errorf("expected the caller to get the whole body %q, received %q", body, b)
+	}
+}
+
+func TestBackoffStrategyFromContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := retryable.New()
+	c.JitterStrategy = retryable.DecorrelatedJitter
+
+	ctx := retryable.NewContext()
+
+	_, err = c.DoWithContext(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	strategy, ok := retryable.BackoffStrategyFromContext(ctx)
+	if !ok {
+		t.Fatal("expected a strategy in the context")
+	}
+
+	if strategy != "decorrelated jitter" {
+		t.Errorf("expected %q, received %q", "decorrelated jitter", strategy)
+	}
+}
+
+func TestWithInstantBackoff(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The default schedule would take tens of seconds to get through this
+	c := retryable.New(retryable.WithInstantBackoff(), retryable.WithMaxAttempts(8))
+
+	ctx := retryable.NewContext()
+	start := time.Now()
+
+	_, err = c.DoWithContext(ctx, req)
+	if err == nil {
+		t.Error("expected an error")
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected no waiting between attempts, took %s", elapsed)
+	}
+
+	attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+	if attempts != 8 {
+		t.Errorf("expected 8, received %d", attempts)
+	}
+}
+
+func TestHttpClient_DoWithContext_RetryPolicyWithHeaders(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		header         string
+		expectAttempts int
+	}{
+		{"Overloaded is retried", "X-Overloaded", 3},
+		{"Maintenance is not", "X-Maintenance", 1},
+		{"Anything else follows the usual rules", "X-Other", 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set(test.header, "true")
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.New(retryable.WithInstantBackoff(), retryable.WithMaxAttempts(3))
+			c.RetryPolicyWithHeaders = func(status int, headers http.Header) (retry, permanent bool) {
+				if status != http.StatusServiceUnavailable {
+					return false, false
+				}
+
+				return headers.Get("X-Overloaded") == "true", headers.Get("X-Maintenance") == "true"
+			}
+
+			ctx := retryable.NewContext()
+
+			_, err = c.DoWithContext(ctx, req)
+			if err == nil {
+				t.Error("expected an error")
+			}
+
+			attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+			if test.expectAttempts != attempts {
+				t.Errorf("expected %d, received %d", test.expectAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoStream(t *testing.T) {
+	var connections int
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connections++
+
+		fmt.Fprintf(w, "line %d\n", connections)
+
+		if connections < 3 {
+			// Drop the connection mid-stream
+			w.(http.Flusher).Flush()
+
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+
+				return
+			}
+
+			_ = conn.Close()
+
+			return
+		}
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+
+	c := retryable.New(retryable.WithInstantBackoff())
+
+	err = c.DoStream(context.Background(), req, func(r io.Reader) error {
+		b, err := io.ReadAll(r)
+		lines = append(lines, string(b))
+
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{"line 1\n", "line 2\n", "line 3\n"}
+	if !reflect.DeepEqual(expect, lines) {
+		t.Errorf("expected %q, received %q", expect, lines)
+	}
+}
+
+func TestHttpClient_DoStream_Drops(t *testing.T) {
+	var connections int
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connections++
+
+		// Drop every connection before any of the body is sent
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+
+			return
+		}
+
+		_ = conn.Close()
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := retryable.NewTestClock(start)
+
+	c := retryable.New(retryable.WithTestClock(clock), retryable.WithMaxAttempts(3))
+	c.JitterStrategy = retryable.NoJitter
+	c.InitialInterval = 100 * time.Millisecond
+	c.Multiplier = 2
+
+	err = c.DoStream(context.Background(), req, func(r io.Reader) error {
+		_, err := io.ReadAll(r)
+
+		return err
+	})
+	if !errors.Is(err, retryable.ErrMaxAttempts) {
+		t.Errorf("expected max attempts, received %v", err)
+	}
+
+	if connections != 3 {
+		t.Errorf("expected 3 connections, received %d", connections)
+	}
+
+	// The schedule carries on across reconnects, rather than starting over
+	if elapsed := clock.Now().Sub(start); elapsed != 300*time.Millisecond {
+		t.Errorf("expected waits of 100ms and 200ms, received %v in all", elapsed)
+	}
+}
+
+func TestHttpClient_DoStream_NotRewindable(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPost, "http://example.com", io.NopCloser(strings.NewReader("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := retryable.New(retryable.WithInstantBackoff())
+
+	err = c.DoStream(context.Background(), req, func(r io.Reader) error {
+		t.Error("expected the request never to be made")
+
+		return nil
+	})
+	if !errors.Is(err, retryable.ErrBodyNotRewindable) {
+		t.Errorf("expected ErrBodyNotRewindable, received %v", err)
+	}
+}
+
+func TestHttpClient_DoWithContext_SuccessStatusRange(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		status         int
+		successRange   [2]int
+		expectAttempts int
+		expectError    bool
+	}{
+		{"3xx is retried by default", http.StatusFound, [2]int{}, 2, true},
+		{"3xx succeeds within the range", http.StatusFound, [2]int{200, 399}, 1, false},
+		{"2xx fails outside of the range", http.StatusNoContent, [2]int{200, 200}, 2, true},
+		{"429 is retried within the range", http.StatusTooManyRequests, [2]int{200, 499}, 2, true},
+		{"4xx succeeds within the range", http.StatusNotFound, [2]int{200, 499}, 1, false},
+		{"4xx fails permanently outside of the range", http.StatusNotFound, [2]int{200, 399}, 1, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Location", "/elsewhere")
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(test.status)
+			}))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.New(retryable.WithInstantBackoff(), retryable.WithMaxAttempts(2))
+			c.Client = &http.Client{
+				CheckRedirect: func(*http.Request, []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			}
+			c.SuccessStatusRange = test.successRange
+
+			ctx := retryable.NewContext()
+
+			_, err = c.DoWithContext(ctx, req)
+			if test.expectError == (err == nil) {
+				t.Errorf("expected error: %v, received %#v", test.expectError, err)
+			}
+
+			attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+			if test.expectAttempts != attempts {
+				t.Errorf("expected %d, received %d", test.expectAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_NextEndpoint(t *testing.T) {
+	var hits []string
+
+	unhealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits = append(hits, "unhealthy")
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer unhealthy.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits = append(hits, "healthy")
+
+		if r.URL.Path != "/things" {
+			t.Errorf("expected the path to be kept, received %q", r.URL.Path)
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	req, err := http.NewRequest(http.MethodGet, unhealthy.URL+"/things", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := req.URL.String()
+
+	var attempts []int
+
+	c := retryable.New(retryable.WithInstantBackoff())
+	c.NextEndpoint = func(req *http.Request, attempt int) *url.URL {
+		attempts = append(attempts, attempt)
+
+		u, err := url.Parse(healthy.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		u.Path = req.URL.Path
+
+		return u
+	}
+
+	_, err = c.DoWithContext(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual([]string{"unhealthy", "healthy"}, hits) {
+		t.Errorf("unexpected hits %q", hits)
+	}
+
+	if !reflect.DeepEqual([]int{2}, attempts) {
+		t.Errorf("expected NextEndpoint to be called for attempt 2 only, received %v", attempts)
+	}
+
+	if req.URL.String() != original {
+		t.Errorf("expected the caller's request to be untouched, received %s", req.URL)
+	}
+}
+
+func TestTraceFromContext(t *testing.T) {
+	ft := faulttransport.New(
+		faulttransport.Status(http.StatusBadGateway),
+		faulttransport.Error(faulttransport.ErrConnectionReset),
+		faulttransport.Status(http.StatusOK),
+	)
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := retryable.NewWithTransport(ft, retryable.WithInstantBackoff())
+	c.Trace = true
+
+	ctx := retryable.NewContext()
+
+	_, err = c.DoWithContext(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trace, ok := retryable.TraceFromContext(ctx)
+	if !ok {
+		t.Fatal("expected a trace in the context")
+	}
+
+	if len(trace) != 3 {
+		t.Fatalf("expected 3 records, received %d", len(trace))
+	}
+
+	for i, expect := range []struct {
+		status   int
+		hasErr   bool
+		hasDelay bool
+	}{
+		{http.StatusBadGateway, true, true},
+		{0, true, true},
+		{http.StatusOK, false, false},
+	} {
+		rec := trace[i]
+
+		if rec.Attempt != i+1 || rec.Status != expect.status || (rec.Err != "") != expect.hasErr || (rec.Delay > 0) != expect.hasDelay {
+			t.Errorf("unexpected record %+v", rec)
+		}
+	}
+}
+
+func TestTraceFromContext_RewrittenEndpoints(t *testing.T) {
+	ft := faulttransport.New(
+		faulttransport.Status(http.StatusBadGateway),
+		faulttransport.Error(faulttransport.ErrConnectionReset),
+		faulttransport.Status(http.StatusOK),
+	)
+
+	req, err := http.NewRequest(http.MethodGet, "http://primary.example.com/things?id=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := retryable.NewWithTransport(ft, retryable.WithInstantBackoff())
+	c.Trace = true
+	c.NextEndpoint = func(req *http.Request, attempt int) *url.URL {
+		u := *req.URL
+		u.Host = fmt.Sprintf("replica-%d.example.com", attempt)
+
+		return &u
+	}
+
+	events := c.Subscribe()
+	ctx := retryable.NewContext()
+
+	_, err = c.DoWithContext(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Unsubscribe(events)
+
+	expect := []string{
+		"http://primary.example.com/things?id=1",
+		"http://replica-2.example.com/things?id=1",
+		"http://replica-3.example.com/things?id=1",
+	}
+
+	trace, _ := retryable.TraceFromContext(ctx)
+	if len(trace) != len(expect) {
+		t.Fatalf("expected %d records, received %d", len(expect), len(trace))
+	}
+
+	for i, rec := range trace {
+		if rec.URL != expect[i] {
+			t.Errorf("attempt %d: expected %q, received %q", rec.Attempt, expect[i], rec.URL)
+		}
+	}
+
+	var received []string
+	for ev := range events {
+		received = append(received, ev.URL)
+	}
+
+	if !slices.Equal(received, expect[:2]) {
+		t.Errorf("expected retry events for %v, received %v", expect[:2], received)
+	}
+}
+
+func TestHttpClient_DoWithContext_PermanentStatusCodes(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		status         int
+		permanent      []int
+		expectAttempts int
+	}{
+		{"500 is retried by default", http.StatusInternalServerError, nil, 2},
+		{"500 fails permanently when listed", http.StatusInternalServerError, []int{500, 501}, 1},
+		{"501 fails permanently when listed", http.StatusNotImplemented, []int{500, 501}, 1},
+		{"502 is still retried", http.StatusBadGateway, []int{500, 501}, 2},
+		{"503 is still retried", http.StatusServiceUnavailable, []int{500, 501}, 2},
+		{"504 is still retried", http.StatusGatewayTimeout, []int{500, 501}, 2},
+		{"502 fails permanently when gateways are listed", http.StatusBadGateway, retryable.GatewayStatusCodes(), 1},
+		{"503 fails permanently when gateways are listed", http.StatusServiceUnavailable, retryable.GatewayStatusCodes(), 1},
+		{"504 fails permanently when gateways are listed", http.StatusGatewayTimeout, retryable.GatewayStatusCodes(), 1},
+		{"500 is retried when gateways are listed", http.StatusInternalServerError, retryable.GatewayStatusCodes(), 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+			}))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.New(retryable.WithInstantBackoff(), retryable.WithMaxAttempts(2))
+			c.PermanentStatusCodes = test.permanent
+
+			ctx := retryable.NewContext()
+
+			_, err = c.DoWithContext(ctx, req)
+			if err == nil {
+				t.Error("expected an error")
+			}
+
+			attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+			if test.expectAttempts != attempts {
+				t.Errorf("expected %d, received %d", test.expectAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_503RetryAfter(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		retryAfter  string
+		initial     time.Duration
+		expectDelay time.Duration
+	}{
+		{"Without Retry-After follows the schedule", "", 10 * time.Millisecond, 10 * time.Millisecond},
+		{"A longer Retry-After wins", "2", 10 * time.Millisecond, 2 * time.Second},
+		{"A longer schedule wins", "1", 5 * time.Second, 5 * time.Second},
+		{"An invalid Retry-After follows the schedule", "soon", 10 * time.Millisecond, 10 * time.Millisecond},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ft := faulttransport.New(
+				faulttransport.Outcome{
+					StatusCode: http.StatusServiceUnavailable,
+					Header:     http.Header{"Retry-After": []string{test.retryAfter}},
+				},
+				faulttransport.Status(http.StatusOK),
+			)
+
+			req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.NewWithTransport(ft, retryable.WithInstantBackoff())
+			c.JitterStrategy = retryable.NoJitter
+			c.InitialInterval = test.initial
+
+			events := c.Subscribe()
+
+			_, err = c.DoWithContext(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c.Unsubscribe(events)
+
+			ev, ok := <-events
+			if !ok {
+				t.Fatal("expected a retry")
+			}
+
+			if test.expectDelay != ev.Delay {
+				t.Errorf("expected %s, received %s", test.expectDelay, ev.Delay)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_QueryParamOnRetry(t *testing.T) {
+	var queries []string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.RawQuery)
+
+		if len(queries) < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"?id=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := retryable.New(retryable.WithInstantBackoff())
+	c.QueryParamOnRetry = func(attempt int) url.Values {
+		return url.Values{"attempt": []string{strconv.Itoa(attempt)}}
+	}
+
+	_, err = c.DoWithContext(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{"attempt=1&id=1", "attempt=2&id=1", "attempt=3&id=1"}
+	if !reflect.DeepEqual(expect, queries) {
+		t.Errorf("expected %q, received %q", expect, queries)
+	}
+
+	if req.URL.RawQuery != "id=1" {
+		t.Errorf("expected the caller's query to be untouched, received %q", req.URL.RawQuery)
+	}
+}
+
+func TestHttpClient_DoWithContext_DisableKeepAlives(t *testing.T) {
+	for _, test := range []struct {
+		name              string
+		disable           bool
+		expectConnections int32
+	}{
+		{"Connections are reused by default", false, 1},
+		{"Connections aren't reused when disabled", true, 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var connections atomic.Int32
+
+			ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					connections.Add(1)
+				}
+			}
+			ts.Start()
+			defer ts.Close()
+
+			c := retryable.NewWithTransport(&http.Transport{})
+			c.DisableKeepAlives = test.disable
+
+			for i := 0; i < 3; i++ {
+				req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				resp, err := c.DoWithContext(context.Background(), req)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				_, _ = io.Copy(io.Discard, resp.Body)
+				_ = resp.Body.Close()
+			}
+
+			if n := connections.Load(); test.expectConnections != n {
+				t.Errorf("expected %d connections, received %d", test.expectConnections, n)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_PerAttemptTimeout(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		growth         float64
+		expectAttempts int
+		expectError    bool
+	}{
+		{"A fixed timeout keeps timing out", 0, 3, true},
+		{"A growing timeout gets there", 2, 3, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(100 * time.Millisecond)
+				fmt.Fprint(w, "slow")
+			}))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// 40ms, then 80ms, then 160ms
+			c := retryable.New(retryable.WithInstantBackoff(), retryable.WithMaxAttempts(3))
+			c.PerAttemptTimeout = 40 * time.Millisecond
+			c.PerAttemptTimeoutGrowth = test.growth
+
+			ctx := retryable.NewContext()
+
+			resp, err := c.DoWithContext(ctx, req)
+			if test.expectError == (err == nil) {
+				t.Fatalf("expected error: %v, received %#v", test.expectError, err)
+			}
+
+			attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+			if test.expectAttempts != attempts {
+				t.Errorf("expected %d, received %d", test.expectAttempts, attempts)
+			}
+
+			if err != nil {
+				return
+			}
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(b) != "slow" {
+				t.Errorf("expected %q, received %q", "slow", b)
+			}
+		})
+	}
+}
+
+// slowReader trickles out body a byte at a time, waiting delay before each
+type slowReader struct {
+	body  *strings.Reader
+	delay time.Duration
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+
+	return s.body.Read(p[:min(len(p), 1)])
+}
+
+func TestHttpClient_DoWithContext_UploadAndResponseTimeouts(t *testing.T) {
+	for _, test := range []struct {
+		name            string
+		uploadDelay     time.Duration
+		responseDelay   time.Duration
+		uploadTimeout   time.Duration
+		responseTimeout time.Duration
+		expectAttempts  int
+		expectError     error
+	}{
+		{"A slow upload gets its own budget", 10 * time.Millisecond, 0, time.Second, 30 * time.Millisecond, 1, nil},
+		{"A slow upload times out", 30 * time.Millisecond, 0, 50 * time.Millisecond, time.Second, 2, retryable.ErrUploadTimeout},
+		{"A slow response times out", 0, 100 * time.Millisecond, time.Second, 30 * time.Millisecond, 2, retryable.ErrResponseTimeout},
+		{"A fast upload leaves the response its own budget", 0, 50 * time.Millisecond, 30 * time.Millisecond, time.Second, 1, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.Copy(io.Discard, r.Body)
+
+				select {
+				case <-time.After(test.responseDelay):
+				case <-r.Context().Done():
+					return
+				}
+
+				fmt.Fprint(w, "done")
+			}))
+			defer ts.Close()
+
+			const payload = "heartbeat"
+
+			req, err := http.NewRequest(http.MethodPost, ts.URL, &slowReader{body: strings.NewReader(payload), delay: test.uploadDelay})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.GetBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(&slowReader{body: strings.NewReader(payload), delay: test.uploadDelay}), nil
+			}
+
+			c := retryable.New(retryable.WithInstantBackoff(), retryable.WithMaxAttempts(2))
+			c.UploadTimeout = test.uploadTimeout
+			c.ResponseTimeout = test.responseTimeout
+			c.Trace = true
+
+			ctx := retryable.NewContext()
+
+			resp, err := c.DoWithContext(ctx, req)
+
+			attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+			if test.expectAttempts != attempts {
+				t.Errorf("expected %d attempts, received %d", test.expectAttempts, attempts)
+			}
+
+			if test.expectError != nil {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+
+				trace, _ := retryable.TraceFromContext(ctx)
+				for _, rec := range trace {
+					if !strings.Contains(rec.Err, test.expectError.Error()) {
+						t.Errorf("attempt %d: expected %q, received %q", rec.Attempt, test.expectError, rec.Err)
+					}
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer resp.Body.Close()
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(b) != "done" {
+				t.Errorf("expected %q, received %q", "done", b)
+			}
+		})
+	}
+}
+
+func TestHitRateLimitFromContext(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		script []faulttransport.Outcome
+		expect bool
+	}{
+		{"Not rate limited", []faulttransport.Outcome{faulttransport.Status(http.StatusBadGateway), faulttransport.Status(http.StatusOK)}, false},
+		{"Rate limited, then successful", []faulttransport.Outcome{faulttransport.Status(http.StatusTooManyRequests), faulttransport.Status(http.StatusOK)}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.NewWithTransport(faulttransport.New(test.script...), retryable.WithInstantBackoff())
+
+			ctx := retryable.NewContext()
+
+			_, err = c.DoWithContext(ctx, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hit, ok := retryable.HitRateLimitFromContext(ctx)
+			if !ok {
+				t.Fatal("expected the flag in the context")
+			}
+
+			if test.expect != hit {
+				t.Errorf("expected %v, received %v", test.expect, hit)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_MaxRetryAfter(t *testing.T) {
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			ft := faulttransport.New(
+				faulttransport.Outcome{
+					StatusCode: status,
+					Header:     http.Header{"Retry-After": []string{"3600"}},
+				},
+				faulttransport.Status(http.StatusOK),
+			)
+
+			req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.NewWithTransport(ft, retryable.WithInstantBackoff())
+			c.JitterStrategy = retryable.NoJitter
+			c.InitialInterval = time.Millisecond
+			c.MaxRetryAfter = 10 * time.Millisecond
+
+			events := c.Subscribe()
+
+			_, err = c.DoWithContext(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c.Unsubscribe(events)
+
+			ev := <-events
+			if ev.Delay != c.MaxRetryAfter {
+				t.Errorf("expected %s, received %s", c.MaxRetryAfter, ev.Delay)
+			}
+		})
+	}
+}
+
+func TestDoAndDecode(t *testing.T) {
+	type widget struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+
+	for _, test := range []struct {
+		name         string
+		status       int
+		body         string
+		expect       widget
+		expectError  bool
+		expectStatus int
+	}{
+		{"Decodes the body", http.StatusOK, `{"name": "sprocket", "count": 3}`, widget{"sprocket", 3}, false, 0},
+		{"Fails on bad JSON", http.StatusOK, `{"name": `, widget{}, true, 0},
+		{"Fails on non-2xx", http.StatusFound, `{"name": "sprocket", "count": 3}`, widget{}, true, http.StatusFound},
+		{"Fails on 4xx", http.StatusNotFound, `{"error": "no such widget"}`, widget{}, true, http.StatusNotFound},
+		{"Fails on 5xx", http.StatusBadGateway, `{"error": "try again"}`, widget{}, true, http.StatusBadGateway},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+				fmt.Fprint(w, test.body)
+			}))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.New(retryable.WithInstantBackoff(), retryable.WithMaxAttempts(2))
+			c.SuccessStatusRange = [2]int{200, 399}
+			c.Client = &http.Client{
+				CheckRedirect: func(*http.Request, []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			}
+
+			w, err := retryable.DoAndDecode[widget](context.Background(), c, req)
+			if test.expectError == (err == nil) {
+				t.Errorf("expected error: %v, received %#v", test.expectError, err)
+			}
+
+			var use retryable.UnexpectedStatusError
+			if errors.As(err, &use) != (test.expectStatus != 0) {
+				t.Errorf("expected an UnexpectedStatusError: %v, received %#v", test.expectStatus != 0, err)
+			}
+
+			if test.expectStatus != 0 && (use.StatusCode != test.expectStatus || string(use.Body) != test.body) {
+				t.Errorf("expected %d with %q, received %d with %q", test.expectStatus, test.body, use.StatusCode, use.Body)
+			}
+
+			if test.expect != w {
+				t.Errorf("expected %+v, received %+v", test.expect, w)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_OnEscalate(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		failures int
+		expect   []int
+	}{
+		{"Doesn't fire within the threshold", 1, nil},
+		{"Fires once beyond the threshold", 5, []int{3}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			script := make([]faulttransport.Outcome, 0, test.failures+1)
+			for i := 0; i < test.failures; i++ {
+				script = append(script, faulttransport.Status(http.StatusBadGateway))
+			}
+
+			script = append(script, faulttransport.Status(http.StatusOK))
+
+			req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var escalations []int
+
+			c := retryable.NewWithTransport(faulttransport.New(script...), retryable.WithInstantBackoff())
+			c.EscalateAfter = 2
+			c.OnEscalate = func(_ *http.Request, attempt int) {
+				escalations = append(escalations, attempt)
+			}
+
+			_, err = c.DoWithContext(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(test.expect, escalations) {
+				t.Errorf("expected %v, received %v", test.expect, escalations)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_OnNotAcceptable(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		relax          bool
+		expectAttempts int
+		expectError    bool
+	}{
+		{"406 is permanent without relaxing", false, 1, true},
+		{"406 is retried once with a relaxed Accept", true, 2, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Accept") != "*/*" {
+					w.WriteHeader(http.StatusNotAcceptable)
+
+					return
+				}
+
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.Header.Set("Accept", "application/vnd.example.v2+json")
+
+			c := retryable.New(retryable.WithInstantBackoff())
+			c.OnNotAcceptable = func(req *http.Request) bool {
+				if test.relax {
+					req.Header.Set("Accept", "*/*")
+				}
+
+				return test.relax
+			}
+
+			ctx := retryable.NewContext()
+
+			_, err = c.DoWithContext(ctx, req)
+			if test.expectError == (err == nil) {
+				t.Errorf("expected error: %v, received %#v", test.expectError, err)
+			}
+
+			attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+			if test.expectAttempts != attempts {
+				t.Errorf("expected %d, received %d", test.expectAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestNewRequestLimited(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		body           string
+		maxBytes       int64
+		expectError    bool
+		expectTooLarge bool
+	}{
+		{"Under the limit", "hello", 10, false, false},
+		{"At the limit", "hello, wor", 10, false, false},
+		{"Over the limit", "hello, world", 10, true, true},
+		{"As large as can be", "hello, world", math.MaxInt64, false, false},
+		{"Empty bodies only", "", 0, false, false},
+		{"Negative limit", "hello", -1, true, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := retryable.NewRequestLimited(http.MethodPost, "http://example.com", bytes.NewBufferString(test.body), test.maxBytes)
+			if test.expectError {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+
+				if test.expectTooLarge != errors.As(err, new(retryable.BodyTooLargeError)) {
+					t.Errorf("expected a BodyTooLargeError: %v, received %#v", test.expectTooLarge, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body, err := req.GetBody()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(b) != test.body {
+				t.Errorf("expected %q, received %q", test.body, b)
+			}
+		})
+	}
+}
+
+func TestReusableBody_Request(t *testing.T) {
+	const payload = `{"status": "alive"}`
+
+	var (
+		mu       sync.Mutex
+		received []string
+	)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		received = append(received, string(b))
+		n := len(received)
+		mu.Unlock()
+
+		// Fail every other attempt, such that every request is rewound for a retry
+		if n%2 == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer ts.Close()
+
+	body, err := retryable.NewReusableBody(strings.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body.Len() != len(payload) {
+		t.Errorf("expected a length of %d, received %d", len(payload), body.Len())
+	}
+
+	c := retryable.New(retryable.WithInstantBackoff())
+
+	for range 3 {
+		req, err := body.Request(http.MethodPost, ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := c.DoWithContext(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+	}
+
+	if len(received) != 6 {
+		t.Fatalf("expected 6 attempts, received %d", len(received))
+	}
+
+	for i, b := range received {
+		if b != payload {
+			t.Errorf("attempt %d: expected %q, received %q", i+1, payload, b)
+		}
+	}
+}
+
+func TestHttpClient_DoWithContext_StopRetryIf(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		body           string
+		expectAttempts int
+	}{
+		{"Transient failures are retried", "try again later", 3},
+		{"Hopeless failures are not", "this will never work", 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprint(w, test.body)
+			}))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.New(retryable.WithInstantBackoff(), retryable.WithMaxAttempts(3))
+			c.StopRetryIf = func(resp *http.Response) bool {
+				b, err := io.ReadAll(resp.Body)
+				if err != nil {
+					return false
+				}
+
+				resp.Body = io.NopCloser(bytes.NewReader(b))
+
+				return bytes.Contains(b, []byte("never"))
+			}
+
+			ctx := retryable.NewContext()
+
+			resp, err := c.DoWithContext(ctx, req)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(b) != test.body {
+				t.Errorf("expected %q, received %q", test.body, b)
+			}
+
+			attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+			if test.expectAttempts != attempts {
+				t.Errorf("expected %d, received %d", test.expectAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_SingleFlight(t *testing.T) {
+	byAuthorization := func(req *http.Request) string {
+		return req.URL.String() + " " + req.Header.Get("Authorization")
+	}
+
+	for _, test := range []struct {
+		name         string
+		method       string
+		singleFlight bool
+		key          func(req *http.Request) string
+		expectHits   int64
+	}{
+		{"GETs are coalesced", http.MethodGet, true, nil, 1},
+		{"POSTs are not", http.MethodPost, true, nil, 5},
+		{"Nothing is coalesced without SingleFlight", http.MethodGet, false, nil, 5},
+		{"Different keys are not", http.MethodGet, true, byAuthorization, 5},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var hits atomic.Int64
+
+			release := make(chan struct{})
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+				<-release
+
+				fmt.Fprint(w, "hello")
+			}))
+			defer ts.Close()
+
+			c := retryable.New(retryable.WithInstantBackoff())
+			c.SingleFlight = test.singleFlight
+			c.SingleFlightKey = test.key
+
+			var wg sync.WaitGroup
+
+			bodies := make([]string, 5)
+			for i := range bodies {
+				wg.Add(1)
+
+				go func() {
+					defer wg.Done()
+
+					req, err := http.NewRequest(test.method, ts.URL, nil)
+					if err != nil {
+						t.Error(err)
+
+						return
+					}
+
+					req.Header.Set("Authorization", fmt.Sprintf("Bearer user-%d", i))
+
+					resp, err := c.DoWithContext(retryable.NewContext(), req)
+					if err != nil {
+						t.Error(err)
+
+						return
+					}
+
+					defer resp.Body.Close()
+
+					b, err := io.ReadAll(resp.Body)
+					if err != nil {
+						t.Error(err)
+					}
+
+					bodies[i] = string(b)
+				}()
+			}
+
+			// Give every call the chance to get going before any can finish
+			time.Sleep(100 * time.Millisecond)
+			close(release)
+			wg.Wait()
+
+			if test.expectHits != hits.Load() {
+				t.Errorf("expected %d, received %d", test.expectHits, hits.Load())
+			}
+
+			for _, b := range bodies {
+				if b != "hello" {
+					t.Errorf("expected %q, received %q", "hello", b)
+				}
+			}
+		})
+	}
+}
+
+// panickingTransport panics on every request while panicking is set
+type panickingTransport struct {
+	panicking atomic.Bool
+}
+
+func (p *panickingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if p.panicking.Load() {
+		panic("boom")
+	}
+
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+}
+
+func TestHttpClient_DoWithContext_SingleFlight_Panic(t *testing.T) {
+	pt := new(panickingTransport)
+	pt.panicking.Store(true)
+
+	c := retryable.NewWithTransport(pt, retryable.WithInstantBackoff())
+	c.SingleFlight = true
+
+	call := func() (recovered any, resp *http.Response, err error) {
+		defer func() {
+			recovered = recover()
+		}()
+
+		req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err = c.DoWithContext(context.Background(), req)
+
+		return nil, resp, err
+	}
+
+	recovered, _, _ := call()
+	if recovered == nil {
+		t.Fatal("expected the panic to reach the caller")
+	}
+
+	// The panicked call mustn't be left in flight, holding up those after it
+	pt.panicking.Store(false)
+
+	done := make(chan error, 1)
+
+	go func() {
+		_, resp, err := call()
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatal("expected the next call not to wait on the one which panicked")
+	}
+}
+
+func TestHttpClient_DoWithContext_RetryableJSONCodes(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		status         int
+		body           string
+		expectAttempts int
+		expectError    bool
+	}{
+		{"Retryable code in a 200 is retried", http.StatusOK, `{"error": {"code": "RATE_LIMITED"}}`, 3, true},
+		{"Retryable code in a 400 is retried", http.StatusBadRequest, `{"error": {"code": "RATE_LIMITED"}}`, 3, true},
+		{"Numeric codes match too", http.StatusOK, `{"error": {"code": 1001}}`, 3, true},
+		{"Other codes are left alone", http.StatusOK, `{"error": {"code": "NOT_FOUND"}}`, 1, false},
+		{"Missing paths are left alone", http.StatusOK, `{"result": 42}`, 1, false},
+		{"Non-JSON bodies are left alone", http.StatusOK, `RATE_LIMITED`, 1, false},
+		{"Non-JSON client errors are still permanent", http.StatusBadRequest, `bad`, 1, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+				fmt.Fprint(w, test.body)
+			}))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.New(retryable.WithInstantBackoff(), retryable.WithMaxAttempts(3))
+			c.JSONErrorCodePath = "error.code"
+			c.RetryableJSONCodes = []string{"RATE_LIMITED", "1001"}
+
+			ctx := retryable.NewContext()
+
+			resp, err := c.DoWithContext(ctx, req)
+			if test.expectError != (err != nil) {
+				t.Errorf("expected error %v, received %v", test.expectError, err)
+			}
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(b) != test.body {
+				t.Errorf("expected %q, received %q", test.body, b)
+			}
+
+			attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+			if test.expectAttempts != attempts {
+				t.Errorf("expected %d, received %d", test.expectAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_DeadlineVersusMaxAttempts(t *testing.T) {
+	for _, test := range []struct {
+		name              string
+		maxAttempts       int
+		ctxTimeout        time.Duration
+		reqTimeout        time.Duration
+		expectDeadline    bool
+		expectMaxAttempts bool
+	}{
+		{"Running out of attempts", 3, 0, 0, false, true},
+		{"Running out of time", 100, 50 * time.Millisecond, 0, true, false},
+		{"Running out of time on the request's context", 100, 0, 50 * time.Millisecond, true, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ft := faulttransport.New(faulttransport.Status(http.StatusServiceUnavailable))
+			ft.Repeat = true
+
+			c := retryable.NewWithTransport(ft, retryable.WithMaxAttempts(test.maxAttempts))
+			c.InitialInterval = 10 * time.Millisecond
+			c.MaxInterval = 10 * time.Millisecond
+
+			ctx := context.Background()
+			if test.ctxTimeout > 0 {
+				var cancel context.CancelFunc
+
+				ctx, cancel = context.WithTimeout(ctx, test.ctxTimeout)
+				defer cancel()
+			}
+
+			reqCtx := context.Background()
+			if test.reqTimeout > 0 {
+				var cancel context.CancelFunc
+
+				reqCtx, cancel = context.WithTimeout(reqCtx, test.reqTimeout)
+				defer cancel()
+			}
+
+			req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, "http://example.com", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = c.DoWithContext(ctx, req)
+
+			if test.expectDeadline != errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("expected deadline %v, received %v", test.expectDeadline, err)
+			}
+
+			if test.expectMaxAttempts != errors.Is(err, retryable.ErrMaxAttempts) {
+				t.Errorf("expected max attempts %v, received %v", test.expectMaxAttempts, err)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoFunc(t *testing.T) {
+	var seen []string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		seen = append(seen, r.Header.Get("X-Build")+":"+string(b))
+
+		if len(seen) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	var builds int
+
+	build := func() (*http.Request, error) {
+		builds++
+
+		// A one-shot body, which couldn't be rewound
+		body := io.NopCloser(strings.NewReader("body " + strconv.Itoa(builds)))
+
+		req, err := http.NewRequest(http.MethodPost, ts.URL, body)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("X-Build", strconv.Itoa(builds))
+
+		return req, nil
+	}
+
+	c := retryable.New(retryable.WithInstantBackoff())
+	ctx := retryable.NewContext()
+
+	_, err := c.DoFunc(ctx, build)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{"1:body 1", "2:body 2", "3:body 3"}
+	if !reflect.DeepEqual(expect, seen) {
+		t.Errorf("expected %v, received %v", expect, seen)
+	}
+
+	attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, received %d", attempts)
+	}
+}
+
+func TestHttpClient_DoFunc_BuildError(t *testing.T) {
+	ft := faulttransport.New(faulttransport.Status(http.StatusServiceUnavailable))
+	ft.Repeat = true
+
+	buildErr := errors.New("no more requests")
+
+	var builds int
+
+	build := func() (*http.Request, error) {
+		builds++
+		if builds > 2 {
+			return nil, buildErr
+		}
+
+		return http.NewRequest(http.MethodGet, "http://example.com", nil)
+	}
+
+	c := retryable.NewWithTransport(ft, retryable.WithInstantBackoff())
+	ctx := retryable.NewContext()
+
+	_, err := c.DoFunc(ctx, build)
+	if !errors.Is(err, buildErr) {
+		t.Errorf("expected %v, received %v", buildErr, err)
+	}
+
+	if ft.Requests() != 2 {
+		t.Errorf("expected 2 requests, received %d", ft.Requests())
+	}
+}
+
+func TestHttpClient_DoWithContext_AutoDecompress(t *testing.T) {
+	var gzipped bytes.Buffer
+
+	zw := gzip.NewWriter(&gzipped)
+	fmt.Fprint(zw, "hello")
+	zw.Close()
+
+	// upper is a stand-in for a third-party decoder
+	upper := func(r io.Reader) (io.ReadCloser, error) {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+
+		return io.NopCloser(bytes.NewReader(bytes.ToUpper(b))), nil
+	}
+
+	for _, test := range []struct {
+		name                 string
+		encoding             string
+		body                 []byte
+		expectAcceptEncoding string
+		expectBody           string
+		expectEncoding       string
+	}{
+		{"gzip is decompressed", "gzip", gzipped.Bytes(), "deflate, gzip, x-upper", "hello", ""},
+		{"Extra decoders are used", "x-upper", []byte("hello"), "deflate, gzip, x-upper", "HELLO", ""},
+		{"Unknown encodings are untouched", "br", []byte("hello"), "deflate, gzip, x-upper", "hello", "br"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				calls          int
+				acceptEncoding string
+			)
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				acceptEncoding = r.Header.Get("Accept-Encoding")
+
+				w.Header().Set("Content-Encoding", test.encoding)
+
+				// The discarded response is compressed too
+				if calls == 1 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+
+				w.Write(test.body)
+			}))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.New(retryable.WithInstantBackoff())
+			c.AutoDecompress = true
+			c.Decoders = map[string]retryable.Decoder{"x-upper": upper}
+
+			resp, err := c.DoWithContext(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer resp.Body.Close()
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.expectBody != string(b) {
+				t.Errorf("expected %q, received %q", test.expectBody, b)
+			}
+
+			if test.expectEncoding != resp.Header.Get("Content-Encoding") {
+				t.Errorf("expected %q, received %q", test.expectEncoding, resp.Header.Get("Content-Encoding"))
+			}
+
+			if test.expectAcceptEncoding != acceptEncoding {
+				t.Errorf("expected %q, received %q", test.expectAcceptEncoding, acceptEncoding)
+			}
+
+			if v := req.Header.Get("Accept-Encoding"); v != "" {
+				t.Errorf("expected the caller's request to be untouched, received %q", v)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_WaitObserver(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		maxElapsedTime time.Duration
+		expectWaits    []time.Duration
+		expectElapsed  time.Duration
+	}{
+		{"Every wait is observed", 0, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}, 7 * time.Second},
+		{"MaxElapsedTime runs on the clock", 5 * time.Second, []time.Duration{time.Second, 2 * time.Second}, 3 * time.Second},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ft := faulttransport.New(faulttransport.Status(http.StatusServiceUnavailable))
+			ft.Repeat = true
+
+			start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			clock := retryable.NewTestClock(start)
+
+			var waits []time.Duration
+
+			c := retryable.NewWithTransport(ft, retryable.WithMaxAttempts(4), retryable.WithTestClock(clock))
+			c.JitterStrategy = retryable.NoJitter
+			c.InitialInterval = time.Second
+			c.Multiplier = 2
+			c.MaxElapsedTime = test.maxElapsedTime
+			c.WaitObserver = func(d time.Duration) {
+				waits = append(waits, d)
+			}
+
+			req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = c.DoWithContext(context.Background(), req)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			if !reflect.DeepEqual(test.expectWaits, waits) {
+				t.Errorf("expected %v, received %v", test.expectWaits, waits)
+			}
+
+			if elapsed := clock.Now().Sub(start); test.expectElapsed != elapsed {
+				t.Errorf("expected %s, received %s", test.expectElapsed, elapsed)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_MaxRetriesHeader(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		header         string
+		maxAttempts    int
+		expectAttempts int
+	}{
+		{"No header", "", 5, 5},
+		{"Header lowers the budget", "1", 5, 3},
+		{"Header may stop retries outright", "0", 5, 2},
+		{"Header never raises the budget", "10", 3, 3},
+		{"Header limits unlimited calls", "2", 0, 4},
+		{"Garbage is ignored", "lots", 5, 5},
+		{"Negative values are ignored", "-1", 5, 5},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// The header turns up on the second response
+			ft := faulttransport.New(
+				faulttransport.Status(http.StatusServiceUnavailable),
+				faulttransport.Outcome{
+					StatusCode: http.StatusServiceUnavailable,
+					Header:     http.Header{"X-Max-Retries": []string{test.header}},
+				},
+				faulttransport.Status(http.StatusServiceUnavailable),
+				faulttransport.Status(http.StatusServiceUnavailable),
+				faulttransport.Status(http.StatusServiceUnavailable),
+				faulttransport.Status(http.StatusServiceUnavailable),
+			)
+
+			c := retryable.NewWithTransport(ft, retryable.WithInstantBackoff(), retryable.WithMaxAttempts(test.maxAttempts))
+			c.MaxRetries = 0
+			c.MaxRetriesHeader = "X-Max-Retries"
+
+			req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := retryable.NewContext()
+
+			_, err = c.DoWithContext(ctx, req)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+			if test.expectAttempts != attempts {
+				t.Errorf("expected %d, received %d", test.expectAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_ReusesConnections(t *testing.T) {
+	var calls int
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, "busy, try again")
+
+			return
+		}
+
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	var reused []bool
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			reused = append(reused, info.Reused)
+		},
+	}
+
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := retryable.NewWithTransport(ts.Client().Transport, retryable.WithInstantBackoff())
+
+	resp, err := c.DoWithContext(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	expect := []bool{false, true, true}
+	if !reflect.DeepEqual(expect, reused) {
+		t.Errorf("expected %v, received %v", expect, reused)
+	}
+}
+
+func TestHttpClient_DoWithContext_CancelledWhileWaiting(t *testing.T) {
+	ft := faulttransport.New(faulttransport.Status(http.StatusServiceUnavailable))
+	ft.Repeat = true
+
+	c := retryable.NewWithTransport(ft)
+	c.InitialInterval = time.Second
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The response had already been drained and closed to free its connection
+	resp, err := c.DoWithContext(ctx, req)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	if resp != nil {
+		t.Errorf("expected no response, received %v", resp.Status)
+	}
+}
+
+func TestContextWithSuccessPredicate(t *testing.T) {
+	notAccepted := func(resp *http.Response) bool {
+		return resp.StatusCode == http.StatusOK
+	}
+
+	for _, test := range []struct {
+		name           string
+		ctx            context.Context
+		expectAttempts int
+	}{
+		{"Client predicate", retryable.NewContext(), 1},
+		{"Per-call predicate", retryable.ContextWithSuccessPredicate(retryable.NewContext(), notAccepted), 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ft := faulttransport.New(
+				faulttransport.Status(http.StatusAccepted),
+				faulttransport.Status(http.StatusAccepted),
+				faulttransport.Status(http.StatusOK),
+			)
+
+			c := retryable.NewWithTransport(ft, retryable.WithInstantBackoff())
+			c.SuccessPredicate = func(resp *http.Response) bool {
+				return resp.StatusCode/100 == 2
+			}
+
+			req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = c.DoWithContext(test.ctx, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			attempts, _ := retryable.NumberOfAttemptsFromContext(test.ctx)
+			if test.expectAttempts != attempts {
+				t.Errorf("expected %d, received %d", test.expectAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_StaleOnError_Credentials(t *testing.T) {
+	byAuthorization := func(req *http.Request) string {
+		return req.URL.String() + " " + req.Header.Get("Authorization")
+	}
+
+	for _, test := range []struct {
+		name        string
+		key         func(req *http.Request) string
+		expectAlice bool
+	}{
+		{"Credentialed responses aren't cached by default", nil, false},
+		{"Keys tell callers apart", byAuthorization, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var healthy atomic.Bool
+			healthy.Store(true)
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !healthy.Load() {
+					w.WriteHeader(http.StatusServiceUnavailable)
+
+					return
+				}
+
+				fmt.Fprintf(w, "for %s", r.Header.Get("Authorization"))
+			}))
+			defer ts.Close()
+
+			c := retryable.New(retryable.WithInstantBackoff(), retryable.WithMaxAttempts(2))
+			c.Cache = retryable.NewMemoryResponseCache()
+			c.CacheKey = test.key
+			c.StaleOnError = true
+
+			call := func(user string) (string, error) {
+				req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				req.Header.Set("Authorization", user)
+
+				resp, err := c.DoWithContext(retryable.NewContext(), req)
+				if err != nil {
+					return "", err
+				}
+
+				defer resp.Body.Close()
+
+				b, err := io.ReadAll(resp.Body)
+
+				return string(b), err
+			}
+
+			_, err := call("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			healthy.Store(false)
+
+			// Bob must never see what Alice was sent
+			body, err := call("bob")
+			if err == nil {
+				t.Errorf("expected bob's call to fail, received %q", body)
+			}
+
+			body, err = call("alice")
+			if test.expectAlice != (err == nil) {
+				t.Fatalf("expected a stale response for alice: %v, received %v", test.expectAlice, err)
+			}
+
+			if test.expectAlice && body != "for alice" {
+				t.Errorf("expected %q, received %q", "for alice", body)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_StaleOnError(t *testing.T) {
+	for _, test := range []struct {
+		name              string
+		staleOnError      bool
+		failStatus        int
+		queryParamOnRetry bool
+		expectStale       bool
+	}{
+		{"Stale response in place of exhausted retries", true, http.StatusServiceUnavailable, false, true},
+		{"Errors without StaleOnError", false, http.StatusServiceUnavailable, false, false},
+		{"Permanent errors are never hidden", true, http.StatusNotFound, false, false},
+		{"Cached under the caller's URL, not the attempt's", true, http.StatusServiceUnavailable, true, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var healthy atomic.Bool
+			healthy.Store(true)
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !healthy.Load() {
+					w.WriteHeader(test.failStatus)
+
+					return
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"version": 1}`)
+			}))
+			defer ts.Close()
+
+			c := retryable.New(retryable.WithInstantBackoff(), retryable.WithMaxAttempts(3))
+			c.Cache = retryable.NewMemoryResponseCache()
+			c.StaleOnError = test.staleOnError
+
+			if test.queryParamOnRetry {
+				c.QueryParamOnRetry = func(attempt int) url.Values {
+					return url.Values{"attempt": {strconv.Itoa(attempt)}}
+				}
+			}
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := c.DoWithContext(retryable.NewContext(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp.Body.Close()
+
+			healthy.Store(false)
+
+			ctx := retryable.NewContext()
+
+			resp, err = c.DoWithContext(ctx, req)
+			if test.expectStale != (err == nil) {
+				t.Fatalf("expected stale %v, received %v", test.expectStale, err)
+			}
+
+			stale, _ := retryable.StaleFromContext(ctx)
+			if test.expectStale != stale {
+				t.Errorf("expected stale %v, received %v", test.expectStale, stale)
+			}
+
+			if !test.expectStale {
+				return
+			}
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(b) != `{"version": 1}` {
+				t.Errorf("unexpected body %q", b)
+			}
+
+			if resp.Header.Get(retryable.StaleHeader) != "true" {
+				t.Errorf("expected %s header", retryable.StaleHeader)
+			}
+
+			if resp.Header.Get("Content-Type") != "application/json" {
+				t.Errorf("expected cached headers, received %v", resp.Header)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_OnConflict(t *testing.T) {
+	hookErr := errors.New("resource has gone")
+
+	for _, test := range []struct {
+		name           string
+		onConflict     func(req *http.Request) error
+		expectErr      error
+		expectAttempts int
+	}{
+		{"409s are permanent without the hook", nil, nil, 1},
+		{"409s are retried with the hook", func(req *http.Request) error {
+			req.Header.Set("If-Match", `"v2"`)
+
+			return nil
+		}, nil, 2},
+		{"Hook errors are permanent", func(req *http.Request) error {
+			return hookErr
+		}, hookErr, 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("If-Match") != `"v2"` {
+					w.WriteHeader(http.StatusConflict)
+
+					return
+				}
+
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer ts.Close()
+
+			req, err := retryable.NewRequest(http.MethodPut, ts.URL, strings.NewReader("update"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.Header.Set("If-Match", `"v1"`)
+
+			c := retryable.New(retryable.WithInstantBackoff())
+			c.OnConflict = test.onConflict
+
+			ctx := retryable.NewContext()
+
+			_, err = c.DoWithContext(ctx, req)
+
+			switch {
+			case test.onConflict == nil && err == nil:
+				t.Error("expected an error")
+			case test.onConflict != nil && !errors.Is(err, test.expectErr):
+				t.Errorf("expected %v, received %v", test.expectErr, err)
+			}
+
+			attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+			if test.expectAttempts != attempts {
+				t.Errorf("expected %d, received %d", test.expectAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_BufferPool(t *testing.T) {
+	var bodies []string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+
+		if len(bodies) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	pool := retryable.NewBufferPool(1 << 20)
+
+	req, err := retryable.NewRequest(http.MethodPost, ts.URL, strings.NewReader("heartbeat"), retryable.WithBufferPool(pool))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := retryable.New(retryable.WithInstantBackoff())
+
+	_, err = c.DoWithContext(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{"heartbeat", "heartbeat", "heartbeat"}
+	if !reflect.DeepEqual(expect, bodies) {
+		t.Errorf("expected %v, received %v", expect, bodies)
+	}
+
+	// The body went back to the pool with the call's success
+	_, err = req.GetBody()
+	if !errors.Is(err, retryable.ErrBodyReleased) {
+		t.Errorf("expected %v, received %v", retryable.ErrBodyReleased, err)
+	}
+}
+
+func TestHttpClient_DoWithContext_BufferResponse(t *testing.T) {
+	for _, test := range []struct {
+		bufferResponse bool
+		expectCalls    int
+		expectReadErr  bool
+	}{
+		{false, 1, true},
+		{true, 2, false},
+	} {
+		t.Run(fmt.Sprint(test.bufferResponse), func(t *testing.T) {
+			var calls int
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+
+				w.Header().Set("Content-Length", "10")
+				fmt.Fprint(w, "hello")
+
+				if calls == 1 {
+					// Drop the connection mid-body
+					w.(http.Flusher).Flush()
+
+					conn, _, err := w.(http.Hijacker).Hijack()
+					if err != nil {
+						t.Error(err)
+
+						return
+					}
+
+					_ = conn.Close()
+
+					return
+				}
+
+				fmt.Fprint(w, "world")
+			}))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.New(retryable.WithInstantBackoff())
+			c.BufferResponse = test.bufferResponse
+
+			resp, err := c.DoWithContext(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer resp.Body.Close()
+
+			b, err := io.ReadAll(resp.Body)
+			if test.expectReadErr != (err != nil) {
+				t.Errorf("expected read error %v, received %v", test.expectReadErr, err)
+			}
+
+			if !test.expectReadErr && string(b) != "helloworld" {
+				t.Errorf("expected %q, received %q", "helloworld", b)
+			}
+
+			if test.expectCalls != calls {
+				t.Errorf("expected %d, received %d", test.expectCalls, calls)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_SuccessOnError(t *testing.T) {
+	deadlines := func(err error) bool {
+		return errors.Is(err, context.DeadlineExceeded)
+	}
+
+	for _, test := range []struct {
+		name           string
+		successOnError func(err error) bool
+		expectSuccess  bool
+	}{
+		{"Errors are errors", nil, false},
+		{"Deadlines are good enough", deadlines, true},
+		{"Other errors aren't", func(err error) bool { return false }, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(50 * time.Millisecond)
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer ts.Close()
+
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.New(retryable.WithInstantBackoff(), retryable.WithMaxAttempts(3))
+			c.PerAttemptTimeout = 10 * time.Millisecond
+			c.SuccessOnError = test.successOnError
+
+			ctx := retryable.NewContext()
+
+			resp, err := c.DoWithContext(ctx, req)
+			if test.expectSuccess != (err == nil) {
+				t.Fatalf("expected success %v, received %v", test.expectSuccess, err)
+			}
+
+			swallowed := retryable.ErrorAsSuccessFromContext(ctx)
+			if test.expectSuccess != (swallowed != nil) {
+				t.Errorf("expected swallowed error %v, received %v", test.expectSuccess, swallowed)
+			}
+
+			if !test.expectSuccess {
+				return
+			}
+
+			if resp != nil {
+				t.Errorf("expected no response, received %v", resp.Status)
+			}
+
+			attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+			if attempts != 1 {
+				t.Errorf("expected 1 attempt, received %d", attempts)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_SuccessOnError_Context(t *testing.T) {
+	ft := faulttransport.New(faulttransport.Status(http.StatusServiceUnavailable))
+	ft.Repeat = true
+
+	c := retryable.NewWithTransport(ft)
+	c.InitialInterval = time.Second
+	c.SuccessOnError = func(err error) bool {
+		return errors.Is(err, context.DeadlineExceeded)
+	}
+
+	ctx, cancel := context.WithTimeout(retryable.NewContext(), 20*time.Millisecond)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := c.DoWithContext(ctx, req)
+	if err != nil || resp != nil {
+		t.Fatalf("expected neither response nor error, received %v, %v", resp, err)
+	}
+
+	reason, _ := retryable.TerminationReasonFromContext(ctx)
+	if reason != retryable.ReasonSuccess {
+		t.Errorf("expected %s, received %s", retryable.ReasonSuccess, reason)
+	}
+}
+
+// swallowingClient returns a client whose every call fails with a 503, which
+// SuccessOnError then takes as success
+func swallowingClient() *retryable.HttpClient {
+	ft := faulttransport.New(faulttransport.Status(http.StatusServiceUnavailable))
+	ft.Repeat = true
+
+	c := retryable.NewWithTransport(ft)
+	c.SuccessOnError = func(error) bool {
+		return true
+	}
+
+	return c
+}
+
+func TestDoAndDecode_SuccessOnError(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := retryable.DoAndDecode[map[string]string](context.Background(), swallowingClient(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != nil {
+		t.Errorf("expected nothing decoded, received %v", v)
+	}
+}
+
+func TestHttpClient_Warmup_SuccessOnError(t *testing.T) {
+	err := swallowingClient().Warmup(context.Background(), "http://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHttpClient_WaitForHealthy_SuccessOnError(t *testing.T) {
+	err := swallowingClient().WaitForHealthy(context.Background(), "http://example.com", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHttpClient_DoStream_SuccessOnError(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = swallowingClient().DoStream(context.Background(), req, func(io.Reader) error {
+		t.Error("expected handler not to be called")
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHttpClient_DoWithContext_Proxy(t *testing.T) {
+	var (
+		proxied []string
+		conns   atomic.Int32
+	)
+
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Plain HTTP requests are sent to the proxy with the full URL
+		proxied = append(proxied, r.URL.String()+" "+r.Header.Get("Proxy-Authorization"))
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	proxy.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	proxy.Start()
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxyURL.User = url.UserPassword("user", "pass")
+
+	c := retryable.New(retryable.WithInstantBackoff())
+	c.Client = &http.Client{Transport: &http.Transport{}}
+	c.Proxy = http.ProxyURL(proxyURL)
+
+	for range 2 {
+		req, err := http.NewRequest(http.MethodGet, "http://example.invalid/thing", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := c.DoWithContext(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_ = resp.Body.Close()
+	}
+
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	expect := []string{"http://example.invalid/thing " + auth, "http://example.invalid/thing " + auth}
+
+	if !reflect.DeepEqual(expect, proxied) {
+		t.Errorf("expected %v, received %v", expect, proxied)
+	}
+
+	// Calls share the one proxied transport, and so its connections
+	if n := conns.Load(); n != 1 {
+		t.Errorf("expected 1 connection to the proxy, received %d", n)
+	}
+}
+
+func TestHttpClient_DoWithContext_Proxy_Unsupported(t *testing.T) {
+	ft := faulttransport.New(faulttransport.Status(http.StatusOK))
+
+	c := retryable.NewWithTransport(ft, retryable.WithInstantBackoff())
+	c.Proxy = http.ProxyFromEnvironment
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := retryable.NewContext()
+
+	_, err = c.DoWithContext(ctx, req)
+	if !errors.Is(err, retryable.ErrProxyUnsupported) {
+		t.Errorf("expected %v, received %v", retryable.ErrProxyUnsupported, err)
+	}
+
+	attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+	if attempts != 1 {
+		t.Errorf("expected 1 attempt, received %d", attempts)
+	}
+}
+
+func TestRetryAfterWaitedFromContext(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		script []faulttransport.Outcome
+		expect time.Duration
+	}{
+		{"Our own backoff", []faulttransport.Outcome{
+			faulttransport.Status(http.StatusServiceUnavailable),
+			faulttransport.Status(http.StatusOK),
+		}, 0},
+		{"429 with Retry-After", []faulttransport.Outcome{
+			{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"7"}}},
+			faulttransport.Status(http.StatusOK),
+		}, 7 * time.Second},
+		{"503 with a longer Retry-After", []faulttransport.Outcome{
+			{StatusCode: http.StatusServiceUnavailable, Header: http.Header{"Retry-After": []string{"5"}}},
+			faulttransport.Status(http.StatusOK),
+		}, 5 * time.Second},
+		{"The most recent wins", []faulttransport.Outcome{
+			{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"7"}}},
+			{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"3"}}},
+			faulttransport.Status(http.StatusOK),
+		}, 3 * time.Second},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := retryable.NewWithTransport(faulttransport.New(test.script...), retryable.WithInstantBackoff())
+			c.InitialInterval = time.Millisecond
+
+			req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := retryable.NewContext()
+
+			_, err = c.DoWithContext(ctx, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			waited, ok := retryable.RetryAfterWaitedFromContext(ctx)
+			if !ok {
+				t.Fatal("expected metadata")
+			}
+
+			if test.expect != waited {
+				t.Errorf("expected %s, received %s", test.expect, waited)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_RedirectMethods(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		status         int
+		preserve       bool
+		follow         []int
+		expectStatus   int
+		expectRequests []string
+	}{
+		{"301s become GETs by default", http.StatusMovedPermanently, false, nil, http.StatusOK,
+			[]string{"POST / payload", "GET /moved "}},
+		{"301s may keep their method and body", http.StatusMovedPermanently, true, nil, http.StatusOK,
+			[]string{"POST / payload", "POST /moved payload"}},
+		{"302s may keep their method and body", http.StatusFound, true, nil, http.StatusOK,
+			[]string{"POST / payload", "POST /moved payload"}},
+		{"303s always become GETs", http.StatusSeeOther, true, nil, http.StatusOK,
+			[]string{"POST / payload", "GET /moved "}},
+		{"307s keep their method and body regardless", http.StatusTemporaryRedirect, false, nil, http.StatusOK,
+			[]string{"POST / payload", "POST /moved payload"}},
+		{"Unlisted redirects aren't followed", http.StatusMovedPermanently, true, []int{307, 308}, http.StatusMovedPermanently,
+			[]string{"POST / payload"}},
+		{"Listed redirects are", http.StatusTemporaryRedirect, true, []int{307, 308}, http.StatusOK,
+			[]string{"POST / payload", "POST /moved payload"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var requests []string
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := io.ReadAll(r.Body)
+				requests = append(requests, r.Method+" "+r.URL.Path+" "+string(b))
+
+				if r.URL.Path == "/" {
+					http.Redirect(w, r, "/moved", test.status)
+
+					return
+				}
+
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer ts.Close()
+
+			req, err := retryable.NewRequest(http.MethodPost, ts.URL, strings.NewReader("payload"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := retryable.New(retryable.WithInstantBackoff())
+			c.PreserveMethodOnRedirect = test.preserve
+			c.FollowStatusCodes = test.follow
+
+			ctx := retryable.NewContext()
+
+			resp, err := c.DoWithContext(ctx, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_ = resp.Body.Close()
+
+			if test.expectStatus != resp.StatusCode {
+				t.Errorf("expected %d, received %d", test.expectStatus, resp.StatusCode)
+			}
+
+			if !reflect.DeepEqual(test.expectRequests, requests) {
+				t.Errorf("expected %q, received %q", test.expectRequests, requests)
+			}
+
+			attempts, _ := retryable.NumberOfAttemptsFromContext(ctx)
+			if attempts != 1 {
+				t.Errorf("expected 1 attempt, received %d", attempts)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_OnRecovery(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		script         []faulttransport.Outcome
+		expectRecovery []int
+	}{
+		{"Success at the first attempt", []faulttransport.Outcome{
+			faulttransport.Status(http.StatusOK),
+		}, nil},
+		{"Success after retries", []faulttransport.Outcome{
+			faulttransport.Status(http.StatusServiceUnavailable),
+			faulttransport.Status(http.StatusBadGateway),
+			faulttransport.Status(http.StatusOK),
+		}, []int{3}},
+		{"No success at all", []faulttransport.Outcome{
+			faulttransport.Status(http.StatusServiceUnavailable),
+			faulttransport.Status(http.StatusServiceUnavailable),
+			faulttransport.Status(http.StatusServiceUnavailable),
+		}, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var recoveries []int
+
+			c := retryable.NewWithTransport(faulttransport.New(test.script...), retryable.WithInstantBackoff(), retryable.WithMaxAttempts(3))
+			c.OnRecovery = func(host string, afterAttempts int) {
+				if host != "example.com" {
+					t.Errorf("unexpected host %q", host)
+				}
+
+				recoveries = append(recoveries, afterAttempts)
+			}
+
+			req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, _ = c.DoWithContext(context.Background(), req)
+
+			if !reflect.DeepEqual(test.expectRecovery, recoveries) {
+				t.Errorf("expected %v, received %v", test.expectRecovery, recoveries)
+			}
+		})
+	}
+}
+
+func TestHttpClient_DoWithContext_OnRecovery_FailedDecompress(t *testing.T) {
+	var calls int
+
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+
+		if calls == 1 {
+			return &http.Response{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable", Body: http.NoBody, Request: req}, nil
+		}
+
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Status:     "200 OK",
+			Header:     http.Header{"Content-Encoding": {"x-broken"}},
+			Body:       io.NopCloser(strings.NewReader("garbage")),
+			Request:    req,
+		}, nil
+	})
+
+	c := retryable.NewWithTransport(rt, retryable.WithInstantBackoff())
+	c.AutoDecompress = true
+	c.Decoders = map[string]retryable.Decoder{
+		"x-broken": func(io.Reader) (io.ReadCloser, error) {
+			return nil, errors.New("corrupt")
+		},
+	}
+	c.OnRecovery = func(string, int) {
+		t.Error("expected no recovery for a call which failed")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.DoWithContext(context.Background(), req)
+	if err == nil {
+		t.Error("expected the call to fail")
+	}
+}
+
+func TestHttpClient_DoWithContext_Endpoints(t *testing.T) {
+	hits := make(map[string]int)
+
+	var mu sync.Mutex
+
+	newBackend := func(name string, status int) *url.URL {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			hits[name+" "+r.URL.Path]++
+			mu.Unlock()
+
+			w.WriteHeader(status)
+		}))
+		t.Cleanup(ts.Close)
+
+		u, err := url.Parse(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return u
+	}
+
+	c := retryable.New(retryable.WithInstantBackoff())
+	c.Rand = mathrand.New(mathrand.NewPCG(1, 1))
+	c.Endpoints = retryable.NewEndpointPool(
+		retryable.Endpoint{URL: newBackend("light", http.StatusOK), Weight: 1},
+		retryable.Endpoint{URL: newBackend("drained", http.StatusOK), Weight: 0},
+		retryable.Endpoint{URL: newBackend("heavy", http.StatusOK), Weight: 3},
+	)
+
+	for range 400 {
+		req, err := http.NewRequest(http.MethodGet, "http://example.invalid/path", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = c.DoWithContext(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if hits["drained /path"] != 0 {
+		t.Errorf("expected no hits on a weightless endpoint, received %d", hits["drained /path"])
+	}
+
+	// Roughly three times the weight should get roughly three times the attempts
+	if light, heavy := hits["light /path"], hits["heavy /path"]; light+heavy != 400 || heavy < 2*light {
+		t.Errorf("unexpected spread: %v", hits)
+	}
+}
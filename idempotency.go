@@ -0,0 +1,64 @@
+package retryable
+
+import (
+	"net/http"
+	"sync"
+)
+
+// IdempotencyKeyHeader is the request header holding a request's idempotency key
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// An IdempotencyStore remembers which idempotency keys have already been used for
+// successful requests, so that HttpClient.Store can stop them being sent twice
+type IdempotencyStore interface {
+	// Seen returns true if key has been marked
+	Seen(key string) bool
+
+	// Mark records that a request with key succeeded
+	Mark(key string)
+}
+
+// MemoryIdempotencyStore is an IdempotencyStore which remembers keys in memory,
+// for the lifetime of the process. It is safe for concurrent use
+type MemoryIdempotencyStore struct {
+	mu   sync.Mutex
+	keys map[string]struct{}
+}
+
+// NewMemoryIdempotencyStore returns an empty MemoryIdempotencyStore
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{keys: make(map[string]struct{})}
+}
+
+// Seen implements the IdempotencyStore interface
+func (s *MemoryIdempotencyStore) Seen(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.keys[key]
+
+	return ok
+}
+
+// Mark implements the IdempotencyStore interface
+func (s *MemoryIdempotencyStore) Mark(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[key] = struct{}{}
+}
+
+// replayedResponse is what DoWithContext returns in place of sending a request
+// whose idempotency key has already succeeded
+func replayedResponse(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Idempotent-Replayed": []string{"true"}},
+		Body:       http.NoBody,
+		Request:    req,
+	}
+}
@@ -0,0 +1,13 @@
+package retryable
+
+import "context"
+
+// A Limiter decides when requests may be made, allowing a rate budget to be shared
+// between many clients, processes, or even whole fleets.
+//
+// See the ratelimit package for an in-process implementation
+type Limiter interface {
+	// Wait blocks until a request may be made to host. Should Wait return an error,
+	// the call is abandoned and that error returned
+	Wait(ctx context.Context, host string) error
+}
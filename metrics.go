@@ -0,0 +1,29 @@
+package retryable
+
+import (
+	"context"
+	"time"
+)
+
+// MetricsRecorder receives measurements of the calls made through an HttpClient,
+// for exporting to a metrics system, such as with the statsd package.
+//
+// Every method is handed the context of the call, from which OperationFromContext
+// gives the name of the operation, where set, for labelling measurements with.
+//
+// Implementations must be safe for concurrent use, and should be quick about it,
+// since they're called inline with requests
+type MetricsRecorder interface {
+	// RecordAttempt is called after every attempt, with the status of its response
+	// (0 where there wasn't one), how long it took, and the error it failed with,
+	// if any
+	RecordAttempt(ctx context.Context, host string, status int, d time.Duration, err error)
+
+	// RecordRetry is called before every retry, with the number of the attempt
+	// which failed, and the delay before the next
+	RecordRetry(ctx context.Context, host string, attempt int, delay time.Duration)
+
+	// RecordCall is called once a call is done, with the number of attempts made,
+	// how long it took in all, and why it stopped
+	RecordCall(ctx context.Context, host string, attempts int, d time.Duration, reason Reason)
+}
@@ -0,0 +1,30 @@
+package retryable
+
+import (
+	"context"
+	"errors"
+	"io"
+	"syscall"
+)
+
+// DefaultRetryableNetErrors is a sensible starting point for
+// HttpClient.RetryableNetErrors, covering connections which were dropped, reset,
+// refused, or timed out
+var DefaultRetryableNetErrors = []error{
+	io.EOF,
+	io.ErrUnexpectedEOF,
+	context.DeadlineExceeded,
+	syscall.ECONNRESET,
+	syscall.ECONNREFUSED,
+}
+
+// isRetryableNetError returns true where err is, or wraps, any of allowed
+func isRetryableNetError(err error, allowed []error) bool {
+	for _, target := range allowed {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
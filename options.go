@@ -0,0 +1,34 @@
+package retryable
+
+// An Option configures an HttpClient, and may be passed to New and friends as an
+// alternative to setting fields on the returned client
+type Option func(*HttpClient)
+
+// WithMaxAttempts sets the total number of attempts a call may make, including
+// the first. See HttpClient.MaxAttempts
+func WithMaxAttempts(n int) Option {
+	return func(h *HttpClient) {
+		h.MaxAttempts = n
+	}
+}
+
+// WithInstantBackoff makes calls retry without waiting between attempts, while
+// otherwise following the usual schedule (so RetryEvent delays, MaxBackoffTotal,
+// and so on, behave as normal). MaxElapsedTime only counts time actually spent.
+//
+// It's meant for tests, which would rather not sleep
+func WithInstantBackoff() Option {
+	return func(h *HttpClient) {
+		h.backOffProvider = instantBackOffs{}
+	}
+}
+
+// WithTestClock has the client tell the time, and wait, by clock, such that tests
+// can check schedules and time limits (MaxElapsedTime, MaxBackoffTotal, and so on)
+// play out at the right simulated moment, without sleeping through them. See
+// HttpClient.Clock
+func WithTestClock(clock *TestClock) Option {
+	return func(h *HttpClient) {
+		h.Clock = clock
+	}
+}
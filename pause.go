@@ -0,0 +1,65 @@
+package retryable
+
+import "context"
+
+// Pause stops any further attempts being made by calls through this client until
+// Resume is called. Attempts already in flight carry on as normal, whereas calls
+// waiting to make their next attempt block until the client is resumed, or until
+// their context is done.
+//
+// This is handy for freezing traffic to a dependency during a known incident or
+// maintenance window, and releasing it cleanly afterwards.
+//
+// Clients not created with New (or friends) must not call Pause while calls are
+// in flight
+func (h *HttpClient) Pause() {
+	if h.state == nil {
+		h.state = newClientState()
+	}
+
+	h.state.mu.Lock()
+	defer h.state.mu.Unlock()
+
+	if h.state.paused == nil {
+		h.state.paused = make(chan struct{})
+	}
+}
+
+// Resume releases any calls blocked by Pause
+func (h *HttpClient) Resume() {
+	if h.state == nil {
+		return
+	}
+
+	h.state.mu.Lock()
+	defer h.state.mu.Unlock()
+
+	if h.state.paused != nil {
+		close(h.state.paused)
+		h.state.paused = nil
+	}
+}
+
+// waitUnpaused blocks while the client is paused, returning early should ctx be
+// done first
+func (s *clientState) waitUnpaused(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	paused := s.paused
+	s.mu.Unlock()
+
+	if paused == nil {
+		return nil
+	}
+
+	select {
+	case <-paused:
+		return nil
+
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
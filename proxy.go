@@ -0,0 +1,53 @@
+package retryable
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+// ErrProxyUnsupported is returned by calls through a client with a Proxy, but whose
+// transport isn't an *http.Transport, and so can't be told to use it
+var ErrProxyUnsupported = errors.New("using a Proxy requires the client's transport to be an *http.Transport")
+
+// proxied returns a clone of base which sends requests via proxy. The clone is
+// made by the first call, and reused thereafter, so that its connections are
+// pooled
+func (s *clientState) proxied(base http.RoundTripper, proxy func(*http.Request) (*url.URL, error)) http.RoundTripper {
+	s.proxyOnce.Do(func() {
+		s.proxyTransport = withProxy(base, proxy)
+	})
+
+	return s.proxyTransport
+}
+
+// withProxy returns a clone of base, which sends requests via proxy
+func withProxy(base http.RoundTripper, proxy func(*http.Request) (*url.URL, error)) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	t, ok := base.(*http.Transport)
+	if !ok {
+		return errorTransport{err: ErrProxyUnsupported}
+	}
+
+	t = t.Clone()
+	t.Proxy = proxy
+
+	return t
+}
+
+// errorTransport fails every request with err
+type errorTransport struct {
+	err error
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t errorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+
+	return nil, t.err
+}
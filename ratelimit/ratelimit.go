@@ -0,0 +1,125 @@
+// Package ratelimit provides a simple, in-process, per-host token bucket, built on
+// golang.org/x/time/rate, which satisfies retryable.Limiter, for the common case of
+// a single process which needs to keep itself in check.
+//
+//	l, err := ratelimit.New(10, 5) // 10 requests a second, per host, in bursts of up to 5
+//	if err != nil {
+//	    panic(err)
+//	}
+//
+//	c := retryable.New()
+//	c.Limiter = l
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/botsandus/retryable"
+	"golang.org/x/time/rate"
+)
+
+var _ retryable.Limiter = (*Limiter)(nil)
+
+// minSweep is the fewest hosts we hold limiters for before looking for ones which
+// may be dropped
+const minSweep = 64
+
+// Limiter allows up to a given rate of requests per host, per second, with bursts
+// of up to a given size.
+//
+// Each host seen gets a rate.Limiter of its own. Those which have sat idle long
+// enough to refill their bucket are indistinguishable from new ones, so are swept
+// away as more hosts turn up; memory use follows the number of hosts which are
+// busy at any one time, rather than every host ever seen
+type Limiter struct {
+	limit rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+	sweepAt  int
+}
+
+// New returns a Limiter allowing limit requests per second to each host, in bursts
+// of up to burst requests. A limit which isn't positive, or a burst of less than
+// 1, would never let anything through, so is refused with an error
+func New(limit rate.Limit, burst int) (*Limiter, error) {
+	if !(limit > 0) {
+		return nil, fmt.Errorf("ratelimit: rate must be positive, received %v", float64(limit))
+	}
+
+	if burst < 1 {
+		return nil, fmt.Errorf("ratelimit: burst must be at least 1, received %d", burst)
+	}
+
+	return &Limiter{
+		limit:    limit,
+		burst:    burst,
+		limiters: make(map[string]*rate.Limiter),
+		sweepAt:  minSweep,
+	}, nil
+}
+
+// Wait implements the retryable.Limiter interface, blocking until a request may
+// be made to host, or until ctx is done
+func (l *Limiter) Wait(ctx context.Context, host string) error {
+	// Reserving, rather than rate.Limiter.Wait, lets us wait out ctx and return
+	// its cause, rather than giving up early on a deadline we'd miss
+	r := l.limiter(host).Reserve()
+
+	delay := r.Delay()
+	if delay == 0 {
+		return nil
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+
+	case <-ctx.Done():
+		// We never used our token, so hand it back
+		r.Cancel()
+
+		return context.Cause(ctx)
+	}
+}
+
+// limiter returns the rate.Limiter for host, making it if need be
+func (l *Limiter) limiter(host string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lim, ok := l.limiters[host]
+	if ok {
+		return lim
+	}
+
+	if len(l.limiters) >= l.sweepAt {
+		l.sweep()
+	}
+
+	lim = rate.NewLimiter(l.limit, l.burst)
+	l.limiters[host] = lim
+
+	return lim
+}
+
+// sweep drops the limiters whose buckets are full, since a new one would behave
+// just the same, and sets when to next sweep
+func (l *Limiter) sweep() {
+	now := time.Now()
+
+	for host, lim := range l.limiters {
+		if lim.TokensAt(now) >= float64(l.burst) {
+			delete(l.limiters, host)
+		}
+	}
+
+	l.sweepAt = max(2*len(l.limiters), minSweep)
+}
@@ -0,0 +1,83 @@
+package ratelimit_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/botsandus/retryable/ratelimit"
+	"golang.org/x/time/rate"
+)
+
+func TestLimiter_Wait(t *testing.T) {
+	l, err := ratelimit.New(20, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+
+	// Two for free, then 50ms apart
+	for i := 0; i < 4; i++ {
+		err = l.Wait(context.Background(), "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("expected to wait around 100ms, waited %s", elapsed)
+	}
+
+	// Other hosts have their own budget
+	start = time.Now()
+
+	err = l.Wait(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("expected not to wait, waited %s", elapsed)
+	}
+}
+
+func TestLimiter_Wait_Cancelled(t *testing.T) {
+	l, err := ratelimit.New(0.1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = l.Wait(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err = l.Wait(ctx, "example.com")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		rate  rate.Limit
+		burst int
+	}{
+		{"Zero rate", 0, 1},
+		{"Negative rate", -1, 1},
+		{"Zero burst", 10, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			l, err := ratelimit.New(test.rate, test.burst)
+			if err == nil {
+				t.Errorf("expected an error, received %v", l)
+			}
+		})
+	}
+}
@@ -2,10 +2,63 @@ package retryable
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
+	"maps"
+	"math"
+	"mime/multipart"
 	"net/http"
+	"slices"
 )
 
+// ErrBodyNotRewindable is returned by ValidateRequest for requests with a body, but
+// no means of getting a fresh copy of it for a retry
+var ErrBodyNotRewindable = errors.New("request body can't be rewound: set GetBody, or use NewRequest")
+
+// ErrBodyDigestMismatch is returned when a request body, rewound for a retry, no
+// longer matches the digest taken by WithContentDigest
+var ErrBodyDigestMismatch = errors.New("rewound request body doesn't match its digest")
+
+// ErrBodyReleased is returned when rewinding a request body which has been handed
+// back to its BufferPool, as happens once a call with it succeeds
+var ErrBodyReleased = errors.New("request body has been returned to its buffer pool")
+
+// A RequestOption configures a request built by NewRequest and friends
+type RequestOption func(*requestOptions)
+
+type requestOptions struct {
+	digest       bool
+	verifyDigest bool
+	pool         *BufferPool
+}
+
+// WithContentDigest sets a Content-Digest header (as per rfc9530) holding the
+// SHA-256 of the request body, taken once as the request is built.
+//
+// With verify set, the body is hashed again every time it's rewound for a retry,
+// and the call fails with ErrBodyDigestMismatch should it ever differ. This costs
+// a pass over the body per attempt, so is best kept to debugging
+func WithContentDigest(verify bool) RequestOption {
+	return func(o *requestOptions) {
+		o.digest = true
+		o.verifyDigest = verify
+	}
+}
+
+// WithBufferPool has the request body buffered in a buffer drawn from p, rather than
+// one of its own. The buffer goes back to p once a call with the request succeeds,
+// after which the request mustn't be sent again; rewinding it fails with
+// ErrBodyReleased. Requests which never succeed leave their buffers to the garbage
+// collector
+func WithBufferPool(p *BufferPool) RequestOption {
+	return func(o *requestOptions) {
+		o.pool = p
+	}
+}
+
 // NewRequest wraps the function from net/http, but with the addition
 // of a `GetBody` function on that request.
 //
@@ -24,17 +77,42 @@ import (
 // Note: you're probably better off providing your own `req.GetBody` function; especially
 // on large requests- this function will read your body into memory, persisting a copy
 // of it until the request finally succeeds and the copy is garbage collected.
-func NewRequest(method, url string, body io.Reader) (*http.Request, error) {
-	buf := new(bytes.Buffer)
+func NewRequest(method, url string, body io.Reader, opts ...RequestOption) (*http.Request, error) {
+	o := newRequestOptions(opts)
+	buf := o.buffer()
 
 	_, err := io.Copy(buf, body)
 	if err != nil {
 		return nil, err
 	}
 
+	return newBufferedRequest(method, url, buf, o)
+}
+
+func newRequestOptions(opts []RequestOption) requestOptions {
+	var o requestOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
+// buffer returns the buffer a request body is to be read into
+func (o requestOptions) buffer() *bytes.Buffer {
+	if o.pool != nil {
+		return o.pool.get()
+	}
+
+	return new(bytes.Buffer)
+}
+
+// newBufferedRequest builds a request whose body is the contents of buf, as per
+// NewRequest
+func newBufferedRequest(method, url string, buf *bytes.Buffer, o requestOptions) (*http.Request, error) {
 	bb := buf.Bytes()
 
-	req, err := http.NewRequest(method, url, buf)
+	req, err := http.NewRequest(method, url, bytes.NewReader(bb))
 	if err != nil {
 		return nil, err
 	}
@@ -43,5 +121,221 @@ func NewRequest(method, url string, body io.Reader) (*http.Request, error) {
 		return io.NopCloser(bytes.NewReader(bb)), nil
 	}
 
+	// Empty bodies have nothing worth keeping, and are best left as http.NoBody
+	switch {
+	case o.pool != nil && len(bb) == 0:
+		o.pool.put(buf)
+
+	case o.pool != nil:
+		req, err = withPooledBody(req, &pooledBuffer{pool: o.pool, buf: buf})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if o.digest {
+		sum := sha256.Sum256(bb)
+		req.Header.Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+
+		if o.verifyDigest {
+			req.GetBody = verifyingGetBody(req.GetBody, sum)
+		}
+	}
+
 	return req, nil
 }
+
+// verifyingGetBody wraps getBody such that every body it returns is checked
+// against sum before being handed over
+func verifyingGetBody(getBody func() (io.ReadCloser, error), sum [sha256.Size]byte) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		body, err := getBody()
+		if err != nil {
+			return nil, err
+		}
+
+		defer body.Close()
+
+		b, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+
+		if sha256.Sum256(b) != sum {
+			return nil, ErrBodyDigestMismatch
+		}
+
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+}
+
+// NewRequestLimited is as NewRequest, but refuses to buffer bodies of more than
+// maxBytes, returning a BodyTooLargeError instead. This guards against bodies from
+// untrusted sources eating all of our memory; the body is only ever held once, so
+// the most it takes is maxBytes (and a byte). A negative maxBytes is an error
+func NewRequestLimited(method, url string, body io.Reader, maxBytes int64, opts ...RequestOption) (*http.Request, error) {
+	if maxBytes < 0 {
+		return nil, fmt.Errorf("maxBytes must not be negative, received %d", maxBytes)
+	}
+
+	// Reading one byte more than allowed tells us whether there was more to come,
+	// unless nothing could be more
+	limit := maxBytes
+	if limit < math.MaxInt64 {
+		limit++
+	}
+
+	o := newRequestOptions(opts)
+	buf := o.buffer()
+
+	n, err := io.Copy(buf, io.LimitReader(body, limit))
+	if err != nil {
+		return nil, err
+	}
+
+	if n > maxBytes {
+		if o.pool != nil {
+			o.pool.put(buf)
+		}
+
+		return nil, BodyTooLargeError{Limit: maxBytes}
+	}
+
+	return newBufferedRequest(method, url, buf, o)
+}
+
+// ReusableBody is a request body buffered once, from which any number of requests
+// may be made, each as per NewRequest. This suits payloads which are sent over and
+// over, such as heartbeats, sparing them a fresh copy every time.
+//
+// Every request made reads from the same buffer, which is never written to again,
+// so a ReusableBody is safe for concurrent use
+type ReusableBody struct {
+	b []byte
+}
+
+// NewReusableBody reads body in full, returning a ReusableBody holding it
+func NewReusableBody(body io.Reader) (*ReusableBody, error) {
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReusableBody{b: b}, nil
+}
+
+// Len returns the size of the body, in bytes
+func (r *ReusableBody) Len() int {
+	return len(r.b)
+}
+
+// Request returns a new request with the body, and a `GetBody` function which
+// rewinds it, as per NewRequest. Requests are independent of one another, and may
+// be sent side by side
+func (r *ReusableBody) Request(method, url string) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(r.b))
+	if err != nil {
+		return nil, err
+	}
+
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(r.b)), nil
+	}
+
+	return req, nil
+}
+
+// NewChunkedRequest is as NewRequest, but leaves the request's ContentLength unknown,
+// so that the body is sent with `Transfer-Encoding: chunked`. Each attempt, retries
+// included, sends the whole body afresh from a buffered copy.
+//
+// The same caveat as NewRequest applies: the body is held in memory
+func NewChunkedRequest(method, url string, body io.Reader, opts ...RequestOption) (*http.Request, error) {
+	req, err := NewRequest(method, url, body, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// NewRequest (via net/http) sets the length from the buffered body; -1 tells
+	// the transport it doesn't know, which it answers with chunked encoding
+	req.ContentLength = -1
+
+	return req, nil
+}
+
+// NewMultipartRequest builds a multipart/form-data request from fields and files,
+// setting the Content-Type (and its boundary) accordingly, and with a `GetBody`
+// function as per NewRequest.
+//
+// Each entry in files is read in full and sent as a file part, using the map key as
+// both the form field name and the filename. Fields and files are written in key
+// order, so the same inputs always produce the same body.
+//
+// Note: the entire encoded body, every file included, is held in memory until the
+// request is garbage collected. For large files you're far better off building the
+// request yourself with a `GetBody` function which re-opens the file on each call,
+// so that retries stream from disk rather than from memory.
+func NewMultipartRequest(method, url string, fields map[string]string, files map[string]io.Reader, opts ...RequestOption) (*http.Request, error) {
+	buf := new(bytes.Buffer)
+	mw := multipart.NewWriter(buf)
+
+	for _, k := range slices.Sorted(maps.Keys(fields)) {
+		err := mw.WriteField(k, fields[k])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, k := range slices.Sorted(maps.Keys(files)) {
+		fw, err := mw.CreateFormFile(k, k)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = io.Copy(fw, files[k])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := mw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := NewRequest(method, url, buf, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	return req, nil
+}
+
+// ValidateRequest returns a descriptive error should req be unsafe to retry, such
+// as when it has a body which can't be rewound (in which case the error wraps
+// ErrBodyNotRewindable), or when it could never be sent at all.
+//
+// DoWithContext doesn't require any of this, but it's handy to find out about
+// such requests when they're queued up, rather than from truncated uploads
+// further down the line
+func ValidateRequest(req *http.Request) error {
+	if req == nil {
+		return errors.New("request is nil")
+	}
+
+	if req.URL == nil {
+		return errors.New("request has no URL")
+	}
+
+	if req.URL.Scheme == "" || req.URL.Host == "" {
+		return fmt.Errorf("request URL %q must be absolute", req.URL)
+	}
+
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return fmt.Errorf("%s %s: %w", req.Method, req.URL, ErrBodyNotRewindable)
+	}
+
+	return nil
+}
@@ -0,0 +1,167 @@
+package retryable
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	backoff "github.com/cenkalti/backoff/v5"
+)
+
+// retryNotify is called with the result of a failed attempt, and the delay
+// before the next one, which fromServer says was set by the server (such as with
+// Retry-After) rather than by our own schedule
+type retryNotify func(resp *http.Response, err error, next time.Duration, fromServer bool)
+
+// retry calls operation until it succeeds, fails permanently, or we run out of
+// attempts, time, or patience, returning the reason it stopped alongside the
+// result of the final attempt. notify is called before each retry.
+//
+// This mirrors backoff.Retry, which we used to call directly, but keeps hold of
+// the things backoff.Retry keeps to itself- such as how long we've spent asleep
+func (h HttpClient) retry(ctx context.Context, bo backoff.BackOff, operation backoff.Operation[*http.Response], notify retryNotify) (*http.Response, Reason, error) {
+	backOffs := h.backOffs()
+	clock := h.clock()
+
+	var (
+		startedAt = clock.Now()
+		slept     time.Duration
+		deadline  time.Time
+	)
+
+	bo.Reset()
+
+	for {
+		resp, err := operation()
+		if err == nil {
+			return resp, ReasonSuccess, nil
+		}
+
+		var permanent *backoff.PermanentError
+		if errors.As(err, &permanent) {
+			// Running out of time on the final attempt is still running out of time
+			var mare MaxAttemptsReachedError
+			if errors.As(err, &mare) {
+				if cerr := context.Cause(ctx); cerr != nil {
+					return resp, ReasonContextCancelled, cerr
+				}
+
+				return resp, ReasonMaxRetries, permanent.Unwrap()
+			}
+
+			return resp, ReasonPermanent, permanent.Unwrap()
+		}
+
+		// The latest deadline from the server stands until replaced
+		var sde *serverDeadlineError
+		if errors.As(err, &sde) {
+			deadline, err = sde.deadline, sde.err
+		}
+
+		if cerr := context.Cause(ctx); cerr != nil {
+			return resp, ReasonContextCancelled, cerr
+		}
+
+		next := bo.NextBackOff()
+		if next == backoff.Stop {
+			return resp, ReasonMaxElapsed, err
+		}
+
+		var fromServer bool
+
+		// Retry-After style errors override the schedule, and reset it
+		var retryAfter *backoff.RetryAfterError
+		if errors.As(err, &retryAfter) {
+			next, fromServer = retryAfter.Duration, true
+			bo.Reset()
+		}
+
+		// Whereas these only ever lengthen it
+		var mde *minimumDelayError
+		if errors.As(err, &mde) {
+			fromServer = fromServer || mde.delay >= next
+			next, err = max(next, mde.delay), mde.err
+		}
+
+		if h.MaxElapsedTime > 0 && clock.Now().Sub(startedAt)+next > h.MaxElapsedTime {
+			return resp, ReasonMaxElapsed, err
+		}
+
+		if h.MaxBackoffTotal > 0 && slept+next > h.MaxBackoffTotal {
+			return resp, ReasonMaxBackoffTotal, err
+		}
+
+		if !deadline.IsZero() && clock.Now().Add(next).After(deadline) {
+			return resp, ReasonServerDeadline, err
+		}
+
+		notify(resp, err, next, fromServer)
+
+		if h.WaitObserver != nil {
+			h.WaitObserver(next)
+		}
+
+		// This response is done with, and leaving it unread would cost its
+		// connection
+		discard(resp)
+
+		// resp went with discard, so there's nothing left to give back
+		err = backOffs.wait(ctx, next)
+		if err != nil {
+			return nil, ReasonContextCancelled, err
+		}
+
+		slept += next
+	}
+}
+
+// serverDeadlineError wraps the error of a failed attempt whose response set a
+// deadline, after which retry must give up
+type serverDeadlineError struct {
+	err      error
+	deadline time.Time
+}
+
+// Error implements the `Error` interface
+func (e *serverDeadlineError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the error of the failed attempt
+func (e *serverDeadlineError) Unwrap() error {
+	return e.err
+}
+
+// parseDeadline parses an absolute timestamp, either as an HTTP-date or as per
+// rfc3339, returning false where it's neither
+func parseDeadline(s string) (time.Time, bool) {
+	t, err := http.ParseTime(s)
+	if err == nil {
+		return t, true
+	}
+
+	t, err = time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t, true
+	}
+
+	return time.Time{}, false
+}
+
+// minimumDelayError wraps the error of a failed attempt which must wait at least
+// delay before the next attempt
+type minimumDelayError struct {
+	err   error
+	delay time.Duration
+}
+
+// Error implements the `Error` interface
+func (e *minimumDelayError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the error of the failed attempt
+func (e *minimumDelayError) Unwrap() error {
+	return e.err
+}
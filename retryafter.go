@@ -0,0 +1,61 @@
+package retryable
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxParsedRetryAfter caps the delays returned by ParseRetryAfter. A year is as
+// good as forever, but leaves room for arithmetic on the delay (such as adding
+// RetryAfterJitter) without overflowing
+const maxParsedRetryAfter = 365 * 24 * time.Hour
+
+// ParseRetryAfter parses the value of a Retry-After header, which rfc9110 allows to
+// be either a number of seconds, or an HTTP-date, into the duration to wait from now.
+//
+// Dates in the past mean there's no need to wait at all, and so return 0. Delays
+// are capped at a year, however many seconds (or however distant a date) the
+// header asks for. The bool is false where header can't be parsed as either,
+// including for negative numbers and fractional seconds, which rfc9110 doesn't
+// allow
+func ParseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0, false
+	}
+
+	if isDigits(header) {
+		seconds, err := strconv.ParseUint(header, 10, 64)
+		if err != nil && !errors.Is(err, strconv.ErrRange) {
+			return 0, false
+		}
+
+		// Also catches anything out of range, for which ParseUint returns its max
+		if seconds > uint64(maxParsedRetryAfter/time.Second) {
+			return maxParsedRetryAfter, true
+		}
+
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	t, err := http.ParseTime(header)
+	if err != nil {
+		return 0, false
+	}
+
+	return min(max(t.Sub(now), 0), maxParsedRetryAfter), true
+}
+
+// isDigits returns true if s is made up of nothing but ASCII digits
+func isDigits(s string) bool {
+	for i := range len(s) {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,53 @@
+// Package retrytest provides assertions for tests of code which makes calls through
+// a retryable.HttpClient, reading what happened from the call's metadata.
+//
+// Pass the context the call was made with, as created by retryable.NewContext:
+//
+//	ctx := retryable.NewContext()
+//
+//	resp, err := c.DoWithContext(ctx, req)
+//	...
+//
+//	retrytest.AssertAttempts(t, ctx, 3)
+package retrytest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/botsandus/retryable"
+)
+
+// AssertAttempts fails the test unless the call made with ctx took exactly want
+// attempts
+func AssertAttempts(t testing.TB, ctx context.Context, want int) {
+	t.Helper()
+
+	got, ok := retryable.NumberOfAttemptsFromContext(ctx)
+	if !ok {
+		t.Errorf("no retryable metadata in context; was it created with retryable.NewContext?")
+
+		return
+	}
+
+	if got != want {
+		t.Errorf("expected %d attempts, received %d", want, got)
+	}
+}
+
+// AssertRetried fails the test unless the call made with ctx was retried at least
+// once
+func AssertRetried(t testing.TB, ctx context.Context) {
+	t.Helper()
+
+	got, ok := retryable.NumberOfAttemptsFromContext(ctx)
+	if !ok {
+		t.Errorf("no retryable metadata in context; was it created with retryable.NewContext?")
+
+		return
+	}
+
+	if got < 2 {
+		t.Errorf("expected the call to be retried, but it took %d attempt(s)", got)
+	}
+}
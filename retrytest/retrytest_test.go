@@ -0,0 +1,66 @@
+package retrytest_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/botsandus/retryable"
+	"github.com/botsandus/retryable/faulttransport"
+	"github.com/botsandus/retryable/retrytest"
+)
+
+// recorder is a testing.TB which records failures, rather than failing the test
+type recorder struct {
+	testing.TB
+
+	failed bool
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(string, ...any) {
+	r.failed = true
+}
+
+func TestAssertions(t *testing.T) {
+	ft := faulttransport.New(
+		faulttransport.Status(http.StatusServiceUnavailable),
+		faulttransport.Status(http.StatusOK),
+	)
+
+	c := retryable.NewWithTransport(ft, retryable.WithInstantBackoff())
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := retryable.NewContext()
+
+	_, err = c.DoWithContext(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name         string
+		assert       func(t testing.TB)
+		expectFailed bool
+	}{
+		{"Correct attempts pass", func(t testing.TB) { retrytest.AssertAttempts(t, ctx, 2) }, false},
+		{"Incorrect attempts fail", func(t testing.TB) { retrytest.AssertAttempts(t, ctx, 1) }, true},
+		{"Missing metadata fails attempts", func(t testing.TB) { retrytest.AssertAttempts(t, context.Background(), 2) }, true},
+		{"Retried calls pass", func(t testing.TB) { retrytest.AssertRetried(t, ctx) }, false},
+		{"Missing metadata fails retried", func(t testing.TB) { retrytest.AssertRetried(t, context.Background()) }, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := &recorder{TB: t}
+			test.assert(r)
+
+			if test.expectFailed != r.failed {
+				t.Errorf("expected failed %v, received %v", test.expectFailed, r.failed)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package retryable
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/debug"
+)
+
+// flight is the result of a call in flight, shared between every caller asking for
+// the same thing while it ran
+type flight struct {
+	body []byte
+	resp *http.Response
+}
+
+// flightPanic carries a panic from a coalesced call to every caller sharing it,
+// each of which panics in turn, just as had they made the call themselves
+type flightPanic struct {
+	value any
+	stack []byte
+}
+
+// Error implements the `Error` interface
+func (p *flightPanic) Error() string {
+	return fmt.Sprintf("coalesced call panicked: %v\n\n%s", p.value, p.stack)
+}
+
+// canCoalesce returns true if the client is configured for SingleFlight, and req
+// may safely share a call with others
+func (h HttpClient) canCoalesce(req *http.Request) bool {
+	if !h.SingleFlight || h.state == nil || !isIdempotent(req.Method) {
+		return false
+	}
+
+	return req.Body == nil || req.Body == http.NoBody
+}
+
+// singleFlightKey returns the key under which req is coalesced with others
+func (h HttpClient) singleFlightKey(req *http.Request) string {
+	if h.SingleFlightKey != nil {
+		return h.SingleFlightKey(req)
+	}
+
+	return req.Method + " " + req.URL.String()
+}
+
+// coalesce calls fn, unless a call with the same key is already in flight, in which
+// case it waits for that call's result instead. Each caller gets its own copy of
+// the response and its body
+func (s *clientState) coalesce(ctx context.Context, key string, fn func() (*http.Response, error)) (*http.Response, error) {
+	ch := s.flights.DoChan(key, func() (v any, err error) {
+		// fn runs on a goroutine of its own, where a panic would take the whole
+		// process down, so is handed to the callers instead
+		defer func() {
+			if r := recover(); r != nil {
+				v, err = nil, &flightPanic{value: r, stack: debug.Stack()}
+			}
+		}()
+
+		resp, err := fn()
+		if resp == nil || resp.Body == nil {
+			return &flight{resp: resp}, err
+		}
+
+		body, rerr := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		if rerr != nil && err == nil {
+			return &flight{}, rerr
+		}
+
+		return &flight{resp: resp, body: body}, err
+	})
+
+	select {
+	case res := <-ch:
+		if p, ok := res.Err.(*flightPanic); ok {
+			panic(p)
+		}
+
+		f, _ := res.Val.(*flight)
+		if f == nil {
+			return nil, res.Err
+		}
+
+		return f.share(res.Err)
+
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+// share returns a copy of the flight's response, with a body of its own
+func (f *flight) share(err error) (*http.Response, error) {
+	if f.resp == nil {
+		return nil, err
+	}
+
+	resp := *f.resp
+	resp.Header = f.resp.Header.Clone()
+	resp.Body = io.NopCloser(bytes.NewReader(f.body))
+	resp.ContentLength = int64(len(f.body))
+
+	return &resp, err
+}
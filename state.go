@@ -0,0 +1,86 @@
+package retryable
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// ErrNoClientState is returned by calls through a client which sets MaxConcurrent,
+// MaxTotalRequests, SingleFlight, or Proxy, but which wasn't created with New (or
+// friends), and so has nowhere to keep track of them. Failing beats quietly not
+// enforcing a limit, or leaking a transport per call
+var ErrNoClientState = errors.New("MaxConcurrent, MaxTotalRequests, SingleFlight and Proxy need a client created with New")
+
+// clientState holds anything which must be shared between the copies of an
+// HttpClient made by its value receivers, and so must be safe for concurrent use
+type clientState struct {
+	mu          sync.Mutex
+	subscribers map[chan RetryEvent]struct{}
+
+	semOnce sync.Once
+	sem     chan struct{}
+
+	requests atomic.Int64
+
+	// paused is closed, and set back to nil, on Resume
+	paused chan struct{}
+
+	proxyOnce      sync.Once
+	proxyTransport http.RoundTripper
+
+	// flights holds calls in flight for SingleFlight
+	flights singleflight.Group
+}
+
+func newClientState() *clientState {
+	return &clientState{
+		subscribers: make(map[chan RetryEvent]struct{}),
+	}
+}
+
+// acquire takes one of n slots for an in-flight call, blocking until one is free
+// or ctx is done. The returned function gives the slot back.
+//
+// The number of slots is fixed by the first call to acquire
+func (s *clientState) acquire(ctx context.Context, n int) (func(), error) {
+	if s == nil || n <= 0 {
+		return func() {}, nil
+	}
+
+	s.semOnce.Do(func() {
+		s.sem = make(chan struct{}, n)
+	})
+
+	select {
+	case s.sem <- struct{}{}:
+		return func() { <-s.sem }, nil
+
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+// takeRequest counts a request against a lifetime quota of n, returning false
+// (without counting it) should the quota already be used up. n of 0 or less means
+// there's no quota
+func (s *clientState) takeRequest(n int64) bool {
+	if s == nil || n <= 0 {
+		return true
+	}
+
+	for {
+		c := s.requests.Load()
+		if c >= n {
+			return false
+		}
+
+		if s.requests.CompareAndSwap(c, c+1) {
+			return true
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Package statsd provides a retryable.MetricsRecorder which sends counters and
+// timers to a statsd agent over UDP, with tags in the DogStatsD style.
+//
+//	rec, err := statsd.New("127.0.0.1:8125", statsd.WithPrefix("myapp.http."), statsd.WithTags("env:prod"))
+//	if err != nil {
+//	    panic(err)
+//	}
+//	defer rec.Close()
+//
+//	c := retryable.New()
+//	c.Metrics = rec
+//
+// The following metrics are sent, each tagged with the host called, and with the
+// operation where the call's context has one (see retryable.ContextWithOperation):
+//
+//   - attempts (counter), tagged with the status of the response
+//   - attempt.duration (timer), tagged with the status of the response
+//   - attempt.errors (counter), for attempts which failed
+//   - retries (counter)
+//   - retry.delay (timer)
+//   - calls (counter), tagged with the reason the call stopped
+//   - call.duration (timer), tagged with the reason the call stopped
+//   - call.attempts (histogram), tagged with the reason the call stopped
+//
+// Metrics are sent one per packet, and any errors in sending them are ignored,
+// as is the statsd way
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/botsandus/retryable"
+)
+
+var _ retryable.MetricsRecorder = (*Recorder)(nil)
+
+// Recorder sends metrics to a statsd agent
+type Recorder struct {
+	conn   net.Conn
+	prefix string
+	tags   []string
+}
+
+// An Option configures a Recorder
+type Option func(*Recorder)
+
+// WithPrefix prefixes the names of all metrics, such as with "myapp.http."
+func WithPrefix(prefix string) Option {
+	return func(r *Recorder) {
+		r.prefix = prefix
+	}
+}
+
+// WithTags adds tags, such as "env:prod", to all metrics
+func WithTags(tags ...string) Option {
+	return func(r *Recorder) {
+		r.tags = append(r.tags, tags...)
+	}
+}
+
+// New returns a Recorder which sends metrics to the statsd agent at addr
+func New(addr string, opts ...Option) (*Recorder, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Recorder{conn: conn}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r, nil
+}
+
+// Close closes the connection to the statsd agent
+func (r *Recorder) Close() error {
+	return r.conn.Close()
+}
+
+// RecordAttempt implements the retryable.MetricsRecorder interface
+func (r *Recorder) RecordAttempt(ctx context.Context, host string, status int, d time.Duration, err error) {
+	tags := append(callTags(ctx, host), "status:"+strconv.Itoa(status))
+
+	r.send("attempts", "1", "c", tags)
+	r.send("attempt.duration", millis(d), "ms", tags)
+
+	if err != nil {
+		r.send("attempt.errors", "1", "c", tags)
+	}
+}
+
+// RecordRetry implements the retryable.MetricsRecorder interface
+func (r *Recorder) RecordRetry(ctx context.Context, host string, _ int, delay time.Duration) {
+	tags := callTags(ctx, host)
+
+	r.send("retries", "1", "c", tags)
+	r.send("retry.delay", millis(delay), "ms", tags)
+}
+
+// RecordCall implements the retryable.MetricsRecorder interface
+func (r *Recorder) RecordCall(ctx context.Context, host string, attempts int, d time.Duration, reason retryable.Reason) {
+	tags := append(callTags(ctx, host), "reason:"+strings.ReplaceAll(reason.String(), " ", "_"))
+
+	r.send("calls", "1", "c", tags)
+	r.send("call.duration", millis(d), "ms", tags)
+	r.send("call.attempts", strconv.Itoa(attempts), "h", tags)
+}
+
+// callTags returns the tags common to every metric of a call: the host, and the
+// operation, where there is one
+func callTags(ctx context.Context, host string) []string {
+	tags := []string{"host:" + host}
+
+	if op, ok := retryable.OperationFromContext(ctx); ok && op != "" {
+		tags = append(tags, "operation:"+op)
+	}
+
+	return tags
+}
+
+// send writes a single metric, in the form `name:value|type|#tag,tag`
+func (r *Recorder) send(name, value, typ string, tags []string) {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "%s%s:%s|%s", r.prefix, name, value, typ)
+
+	all := append(append([]string(nil), r.tags...), tags...)
+	if len(all) > 0 {
+		sb.WriteString("|#")
+		sb.WriteString(strings.Join(all, ","))
+	}
+
+	_, _ = r.conn.Write([]byte(sb.String()))
+}
+
+// millis formats d in milliseconds, as statsd timers expect
+func millis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64)
+}
@@ -0,0 +1,155 @@
+package statsd_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/botsandus/retryable"
+	"github.com/botsandus/retryable/statsd"
+)
+
+func TestRecorder(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer pc.Close()
+
+	rec, err := statsd.New(pc.LocalAddr().String(), statsd.WithPrefix("test."), statsd.WithTags("env:ci"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rec.Close()
+
+	var calls int
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+
+		if calls == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := retryable.New(retryable.WithInstantBackoff())
+	c.Metrics = rec
+
+	_, err = c.DoWithContext(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := readMetrics(t, pc, 10)
+
+	host := strings.TrimPrefix(ts.URL, "http://")
+
+	expect := []string{
+		"test.attempts|c|#env:ci,host:" + host + ",status:502",
+		"test.attempt.duration|ms|#env:ci,host:" + host + ",status:502",
+		"test.attempt.errors|c|#env:ci,host:" + host + ",status:502",
+		"test.retries|c|#env:ci,host:" + host,
+		"test.retry.delay|ms|#env:ci,host:" + host,
+		"test.attempts|c|#env:ci,host:" + host + ",status:200",
+		"test.attempt.duration|ms|#env:ci,host:" + host + ",status:200",
+		"test.calls|c|#env:ci,host:" + host + ",reason:success",
+		"test.call.duration|ms|#env:ci,host:" + host + ",reason:success",
+		"test.call.attempts|h|#env:ci,host:" + host + ",reason:success",
+	}
+
+	if !reflect.DeepEqual(expect, received) {
+		t.Errorf("expected\n%s\nreceived\n%s", strings.Join(expect, "\n"), strings.Join(received, "\n"))
+	}
+}
+
+func TestRecorder_Operation(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer pc.Close()
+
+	rec, err := statsd.New(pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rec.Close()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := retryable.New(retryable.WithInstantBackoff())
+	c.Metrics = rec
+
+	ctx := retryable.ContextWithOperation(context.Background(), "fetch-config")
+
+	_, err = c.DoWithContext(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := readMetrics(t, pc, 5)
+
+	host := strings.TrimPrefix(ts.URL, "http://")
+
+	expect := []string{
+		"attempts|c|#host:" + host + ",operation:fetch-config,status:200",
+		"attempt.duration|ms|#host:" + host + ",operation:fetch-config,status:200",
+		"calls|c|#host:" + host + ",operation:fetch-config,reason:success",
+		"call.duration|ms|#host:" + host + ",operation:fetch-config,reason:success",
+		"call.attempts|h|#host:" + host + ",operation:fetch-config,reason:success",
+	}
+
+	if !reflect.DeepEqual(expect, received) {
+		t.Errorf("expected\n%s\nreceived\n%s", strings.Join(expect, "\n"), strings.Join(received, "\n"))
+	}
+}
+
+// readMetrics reads n metrics from pc. Timings vary, so only names, types, and tags
+// are returned
+func readMetrics(t *testing.T, pc net.PacketConn, n int) []string {
+	t.Helper()
+
+	var received []string
+
+	buf := make([]byte, 1024)
+	for i := 0; i < n; i++ {
+		_ = pc.SetReadDeadline(time.Now().Add(time.Second))
+
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		name, rest, _ := strings.Cut(string(buf[:n]), ":")
+		_, rest, _ = strings.Cut(rest, "|")
+
+		received = append(received, name+"|"+rest)
+	}
+
+	return received
+}
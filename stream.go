@@ -0,0 +1,104 @@
+package retryable
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/cenkalti/backoff/v5"
+)
+
+// DoStream makes req with DoWithContext, handing the response body to handler,
+// which suits long-lived responses such as log tails. Should handler return an
+// error from a dropped connection (as per DefaultRetryableNetErrors), the request
+// is made again, following the usual schedule, and the new body handed to handler.
+// This carries on until handler returns nil, or any other error, or until ctx is
+// done.
+//
+// Drops in a row which come before any of the body arrives count against
+// MaxAttempts (or MaxRetries) and MaxElapsedTime, as retries would; a stream which
+// gets going before it drops starts the schedule, and the count, afresh.
+//
+// Requests with a body need a GetBody function (see NewRequest) to be remade, and
+// are refused with ErrBodyNotRewindable otherwise. Where SuccessOnError takes an
+// error as success there's no body, so handler isn't called, and nil is returned
+func (h HttpClient) DoStream(ctx context.Context, req *http.Request, handler func(io.Reader) error) error {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return fmt.Errorf("%s %s: %w", req.Method, req.URL, ErrBodyNotRewindable)
+	}
+
+	var (
+		bo          = h.backOffs().newBackOff(h)
+		clock       = h.clock()
+		maxAttempts = h.maxAttempts(ctx)
+		startedAt   = clock.Now()
+		attempts    int
+	)
+
+	bo.Reset()
+
+	for {
+		resp, err := h.DoWithContext(ctx, req)
+		if err != nil {
+			discard(resp)
+
+			return err
+		}
+
+		if resp == nil {
+			return nil
+		}
+
+		var received atomic.Int64
+
+		err = handler(countingReadCloser{ReadCloser: resp.Body, n: &received})
+		_ = resp.Body.Close()
+
+		if err == nil {
+			return nil
+		}
+
+		if cerr := context.Cause(ctx); cerr != nil {
+			return errors.Join(err, cerr)
+		}
+
+		if !isRetryableNetError(err, DefaultRetryableNetErrors) {
+			return err
+		}
+
+		// A stream which got going was healthy, for a time at least
+		if received.Load() > 0 {
+			bo.Reset()
+			startedAt = clock.Now()
+			attempts = 0
+		}
+
+		attempts++
+
+		if maxAttempts > 0 && attempts >= maxAttempts {
+			return errors.Join(MaxAttemptsReachedError{c: attempts}, err)
+		}
+
+		next := bo.NextBackOff()
+		if next == backoff.Stop {
+			return err
+		}
+
+		if h.MaxElapsedTime > 0 && clock.Now().Sub(startedAt)+next > h.MaxElapsedTime {
+			return err
+		}
+
+		err = h.backOffs().wait(ctx, next)
+		if err != nil {
+			return err
+		}
+
+		req.Body, err = rewindBody(req)
+		if err != nil {
+			return err
+		}
+	}
+}
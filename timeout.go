@@ -0,0 +1,146 @@
+package retryable
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrUploadTimeout is the cause of attempts which took longer than
+// HttpClient.UploadTimeout to send their request body
+var ErrUploadTimeout = errors.New("request body upload timed out")
+
+// ErrResponseTimeout is the cause of attempts whose response took longer than
+// HttpClient.ResponseTimeout to arrive, and be read
+var ErrResponseTimeout = errors.New("response timed out")
+
+// phasedTimeout bounds the two halves of an attempt separately: sending the request
+// body, and then waiting for, and reading, the response. The second clock only
+// starts once the first stops
+type phasedTimeout struct {
+	cancel   context.CancelCauseFunc
+	response time.Duration
+
+	mu       sync.Mutex
+	timer    *time.Timer
+	uploaded bool
+	done     bool
+}
+
+// withPhasedTimeout returns a copy of req bounded by UploadTimeout and
+// ResponseTimeout, along with the phasedTimeout doing the bounding
+func (h HttpClient) withPhasedTimeout(req *http.Request) (*http.Request, *phasedTimeout) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+
+	p := &phasedTimeout{cancel: cancel, response: h.ResponseTimeout}
+	r := req.WithContext(ctx)
+
+	// A request without a body has nothing to upload, so is straight on to waiting
+	// for its response
+	if req.Body == nil || req.Body == http.NoBody {
+		p.finishUpload()
+
+		return r, p
+	}
+
+	if h.UploadTimeout > 0 {
+		p.timer = time.AfterFunc(h.UploadTimeout, func() {
+			cancel(ErrUploadTimeout)
+		})
+	}
+
+	r.Body = &uploadWatcher{ReadCloser: req.Body, done: p.finishUpload}
+
+	return r, p
+}
+
+// finishUpload stops the upload clock, and starts the response one
+func (p *phasedTimeout) finishUpload() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.uploaded || p.done {
+		return
+	}
+
+	p.uploaded = true
+
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+
+	if p.response > 0 {
+		p.timer = time.AfterFunc(p.response, func() {
+			p.cancel(ErrResponseTimeout)
+		})
+	}
+}
+
+// stop stops both clocks, and releases the attempt's context
+func (p *phasedTimeout) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done = true
+
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+
+	p.cancel(nil)
+}
+
+// responded is called once the attempt has its response (or failed to get one)
+// from the transport. Servers may well answer before the upload is done, in which
+// case the rest of the attempt is down to the response clock. Errors caused by
+// either clock are made to say so
+func (p *phasedTimeout) responded(ctx context.Context, resp *http.Response, err error) (*http.Response, error) {
+	if err != nil {
+		defer p.stop()
+
+		cause := context.Cause(ctx)
+		if (errors.Is(cause, ErrUploadTimeout) || errors.Is(cause, ErrResponseTimeout)) && !errors.Is(err, cause) {
+			err = fmt.Errorf("%w: %w", cause, err)
+		}
+
+		return resp, err
+	}
+
+	p.finishUpload()
+
+	// The response clock covers reading the body, too, so may only be stopped once
+	// the body is closed
+	resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: p.stop}
+
+	return resp, nil
+}
+
+// uploadWatcher calls done once its request body has been read to the end, or
+// closed, whichever comes first
+type uploadWatcher struct {
+	io.ReadCloser
+
+	done func()
+}
+
+// Read implements the io.Reader interface
+func (u *uploadWatcher) Read(p []byte) (int, error) {
+	n, err := u.ReadCloser.Read(p)
+	if errors.Is(err, io.EOF) {
+		u.done()
+	}
+
+	return n, err
+}
+
+// Close implements the io.Closer interface
+func (u *uploadWatcher) Close() error {
+	u.done()
+
+	return u.ReadCloser.Close()
+}
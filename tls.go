@@ -0,0 +1,40 @@
+package retryable
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"syscall"
+)
+
+// isCertificateError returns true where err stems from the server's certificate
+// failing verification, which no amount of retrying is going to fix
+func isCertificateError(err error) bool {
+	var (
+		cve *tls.CertificateVerificationError
+		uae x509.UnknownAuthorityError
+		he  x509.HostnameError
+		cie x509.CertificateInvalidError
+	)
+
+	return errors.As(err, &cve) ||
+		errors.As(err, &uae) ||
+		errors.As(err, &he) ||
+		errors.As(err, &cie)
+}
+
+// isTransientHandshakeError returns true where err looks like the connection was
+// cut off or mangled in transit, rather than refused on principle. Such failures
+// often happen during TLS handshakes with overloaded servers or proxies.
+//
+// tls.RecordHeaderError usually means a connection wasn't speaking TLS at all,
+// which is what a half-dead proxy or load balancer looks like from this side
+func isTransientHandshakeError(err error) bool {
+	var rhe tls.RecordHeaderError
+
+	return errors.As(err, &rhe) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF)
+}
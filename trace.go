@@ -0,0 +1,57 @@
+package retryable
+
+import (
+	"net/http"
+	"time"
+)
+
+// AttemptRecord describes a single attempt made by a call, as recorded when
+// HttpClient.Trace is set
+type AttemptRecord struct {
+	Attempt int `json:"attempt"`
+
+	// URL is where the attempt was actually sent, as of the attempt, following any
+	// endpoint rewriting and redirects
+	URL string `json:"url"`
+
+	// Status and Header are those of the attempt's response, and are empty where
+	// the attempt failed without one
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+
+	// Delay is how long we waited after the attempt before the next, which is 0
+	// for the final attempt
+	Delay    time.Duration `json:"delay"`
+	Duration time.Duration `json:"duration"`
+	Err      string        `json:"error,omitempty"`
+}
+
+// newAttemptRecord records the outcome of an attempt
+func newAttemptRecord(attempt int, req *http.Request, resp *http.Response, err error, d time.Duration) AttemptRecord {
+	rec := AttemptRecord{
+		Attempt:  attempt,
+		URL:      attemptURL(req, resp),
+		Duration: d,
+	}
+
+	if resp != nil {
+		rec.Status = resp.StatusCode
+		rec.Header = resp.Header.Clone()
+	}
+
+	if err != nil {
+		rec.Err = err.Error()
+	}
+
+	return rec
+}
+
+// attemptURL returns the URL an attempt with req was actually sent to which, where
+// redirects were followed, is that of the request which got resp
+func attemptURL(req *http.Request, resp *http.Response) string {
+	if resp != nil && resp.Request != nil && resp.Request.URL != nil {
+		return resp.Request.URL.String()
+	}
+
+	return req.URL.String()
+}
@@ -0,0 +1,77 @@
+package retryable
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// TransferStats counts the bytes moved by a call to DoWithContext.
+//
+// BytesSent is the sum across every attempt (and hedged copy), since each sends the
+// request body all over again. BytesReceived only counts the body of the response
+// handed back to the caller, and only as the caller reads it; read it after you're
+// done with the body
+type TransferStats struct {
+	BytesSent     int64
+	BytesReceived int64
+}
+
+// countingReadCloser adds the number of bytes read through it to n
+type countingReadCloser struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+// Read implements the io.Reader interface
+func (c countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n.Add(int64(n))
+
+	return n, err
+}
+
+// countRequestBody returns a copy of req whose body, if it has one, counts the bytes
+// read from it into n. So do the bodies from its GetBody, which go to hedged copies
+// and redirects
+func countRequestBody(req *http.Request, n *atomic.Int64) *http.Request {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req
+	}
+
+	r := req.WithContext(req.Context())
+	r.Body = countingReadCloser{ReadCloser: req.Body, n: n}
+
+	if getBody := req.GetBody; getBody != nil {
+		r.GetBody = func() (io.ReadCloser, error) {
+			body, err := getBody()
+			if err != nil || body == nil || body == http.NoBody {
+				return body, err
+			}
+
+			return countingReadCloser{ReadCloser: body, n: n}, nil
+		}
+	}
+
+	return r
+}
+
+// lengthVerifyingReadCloser turns an io.EOF which arrives before expect bytes have
+// been read into a TruncatedBodyError
+type lengthVerifyingReadCloser struct {
+	io.ReadCloser
+	expect, read int64
+}
+
+// Read implements the io.Reader interface
+func (l *lengthVerifyingReadCloser) Read(p []byte) (int, error) {
+	n, err := l.ReadCloser.Read(p)
+	l.read += int64(n)
+
+	if errors.Is(err, io.EOF) && l.read < l.expect {
+		return n, TruncatedBodyError{Expected: l.expect, Received: l.read}
+	}
+
+	return n, err
+}
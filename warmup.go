@@ -0,0 +1,43 @@
+package retryable
+
+import (
+	"context"
+	"io"
+	"net/http"
+)
+
+// Warmup sends a HEAD request to url, with the usual retries, so that a pooled
+// connection (TLS handshake and all) is ready and waiting for the next real request
+// to the same host. This takes the cost of connecting off latency-sensitive first
+// calls.
+//
+// Any response which DoWithContext considers successful counts as warm, as does
+// an error which SuccessOnError takes as success
+func (h *HttpClient) Warmup(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := h.DoWithContext(ctx, req)
+	if err != nil {
+		discard(resp)
+
+		return err
+	}
+
+	if resp == nil {
+		return nil
+	}
+
+	// The connection only goes back into the pool once the body has been read
+	// and closed
+	_, err = io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		_ = resp.Body.Close()
+
+		return err
+	}
+
+	return resp.Body.Close()
+}